@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/skriptble/gabble/transport/bosh"
+	"github.com/skriptble/gabble/transport/tcp"
+	"github.com/skriptble/gabble/transport/websocket"
 	"github.com/skriptble/nine/bind"
 	"github.com/skriptble/nine/element/stanza"
 	"github.com/skriptble/nine/namespace"
@@ -38,69 +43,64 @@ func init() {
 }
 
 func main() {
-	reg := NewRegister()
+	reg := bosh.NewMemoryRegister(runStream, time.Minute)
+	defer reg.Close()
 	bt := bosh.NewBodyTransformer(bosh.Body{})
 	handler := bosh.NewHandler(reg, bt, dflt, server)
 	mux := http.NewServeMux()
 	mux.Handle("/", handler)
+	mux.Handle("/xmpp-websocket", websocket.NewHandler(runStream, server))
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("."))))
 	srv := &http.Server{
 		Addr:    ":8088",
 		Handler: mux,
 	}
-	log.Fatal(srv.ListenAndServe())
-}
-
-type register struct {
-	sessions map[string]*bosh.Session
-
-	sync.RWMutex
-}
-
-// NewRegister returns a new initalized Register.
-func NewRegister() bosh.Register {
-	r := new(register)
-	r.sessions = make(map[string]*bosh.Session)
-	return r
-}
-
-// Add adds a session to the Register.
-func (r *register) Add(sid string, s *bosh.Session) {
-	r.Lock()
-	defer r.Unlock()
-	// create a new transport
-	tp := bosh.NewTransport(stream.Receiving, s)
-	runStream(tp)
-	// create ta new stream
-	r.sessions[sid] = s
+	go serveTCP()
+	done := make(chan struct{})
+	go shutdown(srv, handler, done)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
 
-// Remove removes a session from the Register.
-func (r *register) Remove(sid string) {
-	r.Lock()
-	defer r.Unlock()
-	delete(r.sessions, sid)
+// shutdown waits for an interrupt and then terminates the BOSH sessions
+// before stopping the server.
+func shutdown(srv *http.Server, handler *bosh.Handler, done chan<- struct{}) {
+	defer close(done)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	srv.Shutdown(ctx)
 }
 
-// Lookup returns the Session associated with the given sid. If the session
-// doesn't exist, ErrSessionNotFound is returned.
-func (r *register) Lookup(sid string) (s *bosh.Session, err error) {
-	r.RLock()
-	s, ok := r.sessions[sid]
-	r.RUnlock()
-	if !ok {
-		err = bosh.ErrSessionNotFound
-		return
+// serveTCP serves native clients on the standard client port. If cert.pem and
+// key.pem are in the working directory STARTTLS is required and direct TLS is
+// served on port 5223.
+func serveTCP() {
+	srv := tcp.NewServer(runStream, server, nil)
+	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
+	if err == nil {
+		srv.Certificate(server, cert)
+		go func() {
+			if err := srv.ListenAndServeTLS(":5223"); err != nil {
+				log.Println(err)
+			}
+		}()
+	} else {
+		log.Println("TLS disabled: ", err)
 	}
-	if s.Expired() {
-		r.Remove(sid)
-		err = bosh.ErrSessionNotFound
-		s = nil
+	if err := srv.ListenAndServe(":5222"); err != nil {
+		log.Println(err)
 	}
-	return
 }
 
-func runStream(tp stream.Transport) {
+func runStream(tp stream.Transport, domain string) {
 	saslHandler := sasl.NewHandler(map[string]sasl.Mechanism{
 		"PLAIN": sasl.NewPlainMechanism(sasl.FakePlain{}),
 	})
@@ -131,7 +131,7 @@ func runStream(tp stream.Transport) {
 		// sessionHandler,
 	}
 	props := stream.NewProperties()
-	props.Domain = "localhost"
+	props.Domain = domain
 	s := stream.New(tp, elHandler, stream.Receiving).
 		AddFeatureHandlers(fhs...).
 		SetProperties(props)
@@ -0,0 +1,10 @@
+module github.com/skriptble/gabble
+
+go 1.20
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	// nine is required at its master branch, go mod tidy pins it to the
+	// commit it resolves to.
+	github.com/skriptble/nine master
+)
@@ -14,6 +14,7 @@ type Body struct {
 	// BOSH
 	To      string
 	From    string
+	Route   string
 	Lang    string
 	Ver     Version
 	Wait    time.Duration
@@ -33,11 +34,28 @@ type Body struct {
 	Restart      bool
 
 	SID        string
+	Stream     string
 	Requests   int
 	Polling    time.Duration
 	Inactivity time.Duration
 	Accept     string
 	MaxPause   time.Duration
+	Pause      time.Duration
+
+	// Type is set to "terminate" when either side is ending the session.
+	// Condition is the reason for the termination, if there is one.
+	Type      string
+	Condition string
+
+	// Key and NewKey are used for key sequencing, which protects the session
+	// from being hijacked by a third party that has learned the session ID.
+	Key    string
+	NewKey string
+
+	// Report is the RID of a response the client has not acknowledged and
+	// Time is how long ago that response was sent.
+	Report int
+	Time   time.Duration
 
 	Children []element.Element
 }
@@ -51,6 +69,9 @@ func (b Body) TransformElement() (el element.Element) {
 	if b.From != "" {
 		el = el.AddAttr("from", b.From)
 	}
+	if b.Route != "" {
+		el = el.AddAttr("route", b.Route)
+	}
 	if b.Lang != "" {
 		el = el.AddAttr("xml:lang", b.Lang)
 	}
@@ -97,6 +118,10 @@ func (b Body) TransformElement() (el element.Element) {
 		el = el.AddAttr("sid", b.SID)
 	}
 
+	if b.Stream != "" {
+		el = el.AddAttr("stream", b.Stream)
+	}
+
 	if b.Requests != 0 {
 		el = el.AddAttr("requests", strconv.Itoa(b.Requests))
 	}
@@ -117,6 +142,31 @@ func (b Body) TransformElement() (el element.Element) {
 		el = el.AddAttr("maxpause", fmt.Sprintf("%d", b.MaxPause/time.Second))
 	}
 
+	if b.Pause != time.Duration(0) {
+		el = el.AddAttr("pause", fmt.Sprintf("%d", b.Pause/time.Second))
+	}
+
+	if b.Type != "" {
+		el = el.AddAttr("type", b.Type)
+	}
+
+	if b.Condition != "" {
+		el = el.AddAttr("condition", b.Condition)
+	}
+
+	if b.Key != "" {
+		el = el.AddAttr("key", b.Key)
+	}
+
+	if b.NewKey != "" {
+		el = el.AddAttr("newkey", b.NewKey)
+	}
+
+	if b.Report != 0 {
+		el = el.AddAttr("report", strconv.Itoa(b.Report))
+		el = el.AddAttr("time", fmt.Sprintf("%d", b.Time/time.Millisecond))
+	}
+
 	for _, child := range b.Children {
 		el = el.AddChild(child)
 		if child.Space == "stream" {
@@ -145,6 +195,7 @@ func NewBodyTransformer(dflt Body) BodyTransformer {
 func (bt BodyTransformer) TransformBody(el element.Element) (b Body) {
 	b.To = el.SelectAttrValue("to", "")
 	b.From = el.SelectAttrValue("from", "")
+	b.Route = el.SelectAttrValue("route", "")
 	b.Lang = el.SelectAttrValue("xml:lang", bt.dflt.Lang)
 	b.Accept = el.SelectAttrValue("accept", bt.dflt.Accept)
 	b.Ver = bt.parseVersion(el.SelectAttrValue("ver", ""))
@@ -152,6 +203,9 @@ func (bt BodyTransformer) TransformBody(el element.Element) (b Body) {
 	b.Polling = bt.parsePolling(el.SelectAttrValue("polling", ""))
 	b.Inactivity = bt.parseInactivity(el.SelectAttrValue("inactivity", ""))
 	b.MaxPause = bt.parseMaxPause(el.SelectAttrValue("maxpause", ""))
+	if seconds, err := strconv.Atoi(el.SelectAttrValue("pause", "")); err == nil {
+		b.Pause = time.Duration(seconds) * time.Second
+	}
 	b.Hold = bt.parseHold(el.SelectAttrValue("hold", ""))
 	b.Requests = bt.parseRequests(el.SelectAttrValue("requests", ""))
 	if str := el.SelectAttrValue("ack", ""); str != "" {
@@ -162,6 +216,7 @@ func (bt BodyTransformer) TransformBody(el element.Element) (b Body) {
 	}
 	b.Content = el.SelectAttrValue("content", bt.dflt.Content)
 	b.SID = el.SelectAttrValue("sid", "")
+	b.Stream = el.SelectAttrValue("stream", "")
 	if rid, err := strconv.Atoi(el.SelectAttrValue("rid", "")); err == nil {
 		b.RID = rid
 	}
@@ -172,6 +227,16 @@ func (bt BodyTransformer) TransformBody(el element.Element) (b Body) {
 	if el.SelectAttrValue("xmpp:restartlogic", "false") == "true" {
 		b.RestartLogic = true
 	}
+	b.Type = el.SelectAttrValue("type", "")
+	b.Condition = el.SelectAttrValue("condition", "")
+	b.Key = el.SelectAttrValue("key", "")
+	b.NewKey = el.SelectAttrValue("newkey", "")
+	if report, err := strconv.Atoi(el.SelectAttrValue("report", "")); err == nil {
+		b.Report = report
+		if ms, err := strconv.Atoi(el.SelectAttrValue("time", "")); err == nil {
+			b.Time = time.Duration(ms) * time.Millisecond
+		}
+	}
 	for _, child := range el.ChildElements() {
 		b.Children = append(b.Children, child)
 	}
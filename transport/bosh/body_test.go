@@ -15,6 +15,7 @@ func TestBodyTransformElement(t *testing.T) {
 	body1 := Body{
 		To:           "foo@bar",
 		From:         "baz@quux",
+		Route:        "xmpp:example.com:9999",
 		Lang:         "en-gb",
 		Ver:          Version{Major: 1, Minor: 4},
 		Wait:         5 * time.Second,
@@ -26,17 +27,26 @@ func TestBodyTransformElement(t *testing.T) {
 		RestartLogic: true,
 		Restart:      true,
 		SID:          "bo12345sh",
+		Stream:       "ab12",
 		Requests:     7,
 		Polling:      3 * time.Second,
 		Inactivity:   37 * time.Second,
 		Accept:       "deflate,gzip",
 		MaxPause:     93 * time.Second,
+		Pause:        61 * time.Second,
+		Type:         "terminate",
+		Condition:    "policy-violation",
+		Key:          "bfb06a6f113cd6fd3838ab9d300fdb4fe3da2f7d",
+		NewKey:       "5e7ef5b8e38a2a4a3f15b5ef86c5e05b6d1bc8cf",
+		Report:       619727392815,
+		Time:         1200 * time.Millisecond,
 		Children:     []element.Element{element.New("message")},
 		HoldSet:      true,
 	}
 	want := body.
 		AddAttr("to", "foo@bar").
 		AddAttr("from", "baz@quux").
+		AddAttr("route", "xmpp:example.com:9999").
 		AddAttr("xml:lang", "en-gb").
 		AddAttr("ver", "1.4").
 		AddAttr("wait", "5").
@@ -48,11 +58,19 @@ func TestBodyTransformElement(t *testing.T) {
 		AddAttr("content", "application/xml; charset=utf-8").
 		AddAttr("rid", "619727392817").
 		AddAttr("sid", "bo12345sh").
+		AddAttr("stream", "ab12").
 		AddAttr("requests", "7").
 		AddAttr("polling", "3").
 		AddAttr("inactivity", "37").
 		AddAttr("accept", "deflate,gzip").
 		AddAttr("maxpause", "93").
+		AddAttr("pause", "61").
+		AddAttr("type", "terminate").
+		AddAttr("condition", "policy-violation").
+		AddAttr("key", "bfb06a6f113cd6fd3838ab9d300fdb4fe3da2f7d").
+		AddAttr("newkey", "5e7ef5b8e38a2a4a3f15b5ef86c5e05b6d1bc8cf").
+		AddAttr("report", "619727392815").
+		AddAttr("time", "1200").
 		AddAttr("xmlns:xmpp", namespace.XMPP).
 		AddChild(element.New("message"))
 	got := body1.TransformElement()
@@ -76,6 +94,7 @@ func TestBodyTransformer(t *testing.T) {
 	elem1 := element.New("body").
 		AddAttr("to", "foo@bar").
 		AddAttr("from", "baz@quux").
+		AddAttr("route", "xmpp:example.com:9999").
 		AddAttr("xml:lang", "en-gb").
 		AddAttr("ver", "1.4").
 		AddAttr("wait", "5").
@@ -84,6 +103,7 @@ func TestBodyTransformer(t *testing.T) {
 		AddAttr("content", "application/xml; charset=utf-8").
 		AddAttr("sid", "bo12345sh").
 		AddAttr("rid", "619727392817").
+		AddAttr("stream", "ab12").
 		AddAttr("xmpp:version", "2.0").
 		AddAttr("xmpp:restartlogic", "true").
 		AddAttr("xmpp:restart", "true").
@@ -92,11 +112,19 @@ func TestBodyTransformer(t *testing.T) {
 		AddAttr("inactivity", "37").
 		AddAttr("accept", "deflate,gzip").
 		AddAttr("maxpause", "93").
+		AddAttr("pause", "61").
+		AddAttr("type", "terminate").
+		AddAttr("condition", "policy-violation").
+		AddAttr("key", "bfb06a6f113cd6fd3838ab9d300fdb4fe3da2f7d").
+		AddAttr("newkey", "5e7ef5b8e38a2a4a3f15b5ef86c5e05b6d1bc8cf").
+		AddAttr("report", "619727392815").
+		AddAttr("time", "1200").
 		AddChild(element.New("message"))
 	elem2 := element.New("body")
 	body1 := Body{
 		To:           "foo@bar",
 		From:         "baz@quux",
+		Route:        "xmpp:example.com:9999",
 		Lang:         "en-gb",
 		Ver:          Version{Major: 1, Minor: 4},
 		Wait:         5 * time.Second,
@@ -108,11 +136,19 @@ func TestBodyTransformer(t *testing.T) {
 		RestartLogic: true,
 		Restart:      true,
 		SID:          "bo12345sh",
+		Stream:       "ab12",
 		Requests:     7,
 		Polling:      3 * time.Second,
 		Inactivity:   37 * time.Second,
 		Accept:       "deflate,gzip",
 		MaxPause:     93 * time.Second,
+		Pause:        61 * time.Second,
+		Type:         "terminate",
+		Condition:    "policy-violation",
+		Key:          "bfb06a6f113cd6fd3838ab9d300fdb4fe3da2f7d",
+		NewKey:       "5e7ef5b8e38a2a4a3f15b5ef86c5e05b6d1bc8cf",
+		Report:       619727392815,
+		Time:         1200 * time.Millisecond,
 		Children:     []element.Element{element.New("message")},
 	}
 	body2 := Body{
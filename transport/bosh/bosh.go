@@ -6,10 +6,13 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/skriptble/gabble/transport/internal/xmpp"
 	"github.com/skriptble/nine/element"
 )
 
@@ -20,6 +23,33 @@ type Handler struct {
 	bt     BodyTransformer
 	dflt   Body
 	server string
+	// keys is true if clients must use key sequencing.
+	keys bool
+	// hosts reports if the given domain is served by this handler. If it is
+	// nil only server is served.
+	hosts func(domain string) bool
+	// compress is the size in bytes above which response bodies are
+	// compressed. If it is negative responses are never compressed.
+	compress int
+	// maxBody is the largest request body in bytes that is read, both as
+	// sent and once decompressed.
+	maxBody int64
+	// origins, headers, and maxAge are the CORS policy for browsers making
+	// cross-origin requests.
+	origins []string
+	headers []string
+	maxAge  time.Duration
+
+	// sessions are the sessions created by the handler that are still
+	// running. closing is true once the handler is shutting down, and
+	// shutdownURI is where clients are sent when it does.
+	sessions    map[string]*Session
+	closing     bool
+	shutdownURI string
+	lock        sync.Mutex
+
+	// hooks observe the lifecycle of the sessions created by the handler.
+	hooks Hooks
 }
 
 // NewHandler creates a new Handler and returns it
@@ -29,6 +59,46 @@ func NewHandler(r Register, bt BodyTransformer, dflt Body, server string) *Handl
 	h.bt = bt
 	h.dflt = dflt
 	h.server = server
+	h.compress = defaultCompressThreshold
+	h.maxBody = defaultMaxBodySize
+	return h
+}
+
+// RequireKeys sets whether clients must use key sequencing. Sessions that use
+// key sequencing always have their keys verified, this additionally rejects
+// session creation requests that do not include a newkey.
+func (h *Handler) RequireKeys(required bool) *Handler {
+	h.keys = required
+	return h
+}
+
+// ServeDomains sets the domains served by the handler. Clients that request a
+// session for any other domain receive a host-unknown error.
+func (h *Handler) ServeDomains(domains ...string) *Handler {
+	return h.ResolveDomains(xmpp.Domains(domains...))
+}
+
+// ResolveDomains sets the function used to determine if a domain is served by
+// the handler. This allows the served domains to change while the handler is
+// running.
+func (h *Handler) ResolveDomains(fn func(domain string) bool) *Handler {
+	h.hosts = fn
+	return h
+}
+
+// Compress sets the size in bytes above which response bodies are compressed
+// for clients that accept a supported content encoding. A negative threshold
+// disables compression.
+func (h *Handler) Compress(threshold int) *Handler {
+	h.compress = threshold
+	return h
+}
+
+// MaxBodySize sets the largest request body in bytes the handler reads. The
+// limit applies to compressed bodies both as sent and once decompressed, and
+// larger bodies are rejected with 413 Request Entity Too Large.
+func (h *Handler) MaxBodySize(n int64) *Handler {
+	h.maxBody = n
 	return h
 }
 
@@ -44,12 +114,39 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	var err error
 	var el element.Element
 
-	if r.Method != "POST" {
+	switch r.Method {
+	case "POST":
+		h.cors(rw, r, false)
+	case "OPTIONS":
+		h.cors(rw, r, true)
+		rw.Header().Set("Allow", "POST, OPTIONS")
+		rw.WriteHeader(http.StatusOK)
+		return
+	default:
+		rw.Header().Set("Allow", "POST, OPTIONS")
 		rw.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	rw.Header().Set("Content-Type", defaultContentType)
 
-	b, err := ioutil.ReadAll(r.Body)
+	// Compressed bodies are limited both as sent and once decompressed.
+	r.Body = http.MaxBytesReader(rw, r.Body, h.maxBody)
+	body, err := decompress(r)
+	if err != nil {
+		log.Println(err)
+		if tooLarge(err) == ErrBodyTooLarge {
+			h.tooLarge(rw)
+			return
+		}
+		h.terminate(rw, ErrBadRequest, true)
+		return
+	}
+	b, err := readAll(body, h.maxBody)
+	if err == ErrBodyTooLarge {
+		log.Println(err)
+		h.tooLarge(rw)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
@@ -59,61 +156,104 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	dec := xml.NewDecoder(buf)
 	token, err := dec.RawToken()
 	if err != nil {
-		// TODO(skriptble): This should close the stream.
 		log.Println(err)
-		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		h.terminate(rw, ErrBadRequest, true)
 		return
 	}
 	switch elem := token.(type) {
 	case xml.StartElement:
 		if elem.Name.Local != "body" {
-			b := BadRequest.WriteBytes()
-			rw.Write(b)
 			log.Println("Not a body element")
+			h.terminate(rw, ErrBadRequest, true)
 			return
 		}
 		el, err = h.createElement(elem, dec)
 		if err != nil {
-			b := BadRequest.WriteBytes()
-			rw.Write(b)
 			log.Println("Couldn't create the element")
 			log.Println(err)
+			h.terminate(rw, ErrBadRequest, true)
 			return
 		}
 	default:
-		b := BadRequest.WriteBytes()
-		rw.Write(b)
 		log.Println("Malformed XML")
+		h.terminate(rw, ErrBadRequest, true)
 		return
 	}
-	fmt.Println(el)
 	bdy := h.bt.TransformBody(el)
+	// Clients that do not send a version when creating a session expect the
+	// deprecated HTTP error codes instead of terminal binding conditions.
+	legacy := bdy.SID == "" && el.SelectAttrValue("ver", "") == ""
 	if bdy.RID == 0 {
-		b := BadRequest.WriteBytes()
-		rw.Write(b)
+		h.terminate(rw, ErrBadRequest, legacy)
 		return
 	}
 	// If there is no session id, create a new session and stream, run the
 	// stream, and write a bosh session creation response
 	// 	- Handle version matching for xmpp and bosh here
-	//  - Handle handling of route here. Make sure it matches the server we can
-	//	  route to
 	var rsp Body
 	if bdy.SID == "" {
-		rsp = h.negotiate(bdy)
+		domain, ok := h.domain(bdy.To)
+		if !ok {
+			log.Println("Session creation request for unknown host ", bdy.To)
+			h.terminate(rw, ErrHostUnknown, legacy)
+			return
+		}
+		if bdy.Restart {
+			log.Println("Restart request without a session")
+			h.terminate(rw, ErrBadRequest, legacy)
+			return
+		}
+		if h.keys && bdy.NewKey == "" {
+			log.Println("Session creation request without newkey")
+			h.terminate(rw, ErrBadRequest, legacy)
+			return
+		}
+		if h.shuttingDown() {
+			log.Println("Session creation request during shutdown")
+			h.terminate(rw, h.shutdownError(), legacy)
+			return
+		}
+		rsp = h.negotiate(bdy, domain)
+		// Clients are only offered multiple streams if the register can
+		// handle them.
+		if _, ok := h.streamRegister(); ok {
+			rsp.Stream = xmpp.StreamID()
+		}
 		log.Println("Creating session.")
-		s := NewSession(rsp.SID, bdy.RID, rsp.Hold, rsp.Wait, rsp.Inactivity)
+		s := NewSessionFromResponse(bdy.RID, rsp)
+		if !h.track(s) {
+			log.Println("Session creation request during shutdown")
+			s.Close()
+			h.terminate(rw, h.shutdownError(), legacy)
+			return
+		}
+		s.legacy = legacy
+		s.acks = bdy.Ack == 1
+		s.route = bdy.Route
+		s.accept = bdy.Accept
+		s.content = bdy.Content
+		if h.hooks != nil {
+			s.SetHooks(h.hooks)
+			h.hooks.OnSessionCreated(s)
+		}
+		// The key is set before the session is registered so no request
+		// can be processed without one.
+		if bdy.NewKey != "" {
+			s.setKey(bdy.RID, bdy.NewKey)
+		}
+		rw.Header().Set("Content-Type", s.ContentType())
 		h.r.Add(rsp.SID, s)
-		req := NewRequest(bdy.RID, rsp.Wait, rsp.SID, bdy, rsp, s.UnregisterRequest())
+		req := NewRequest(bdy.RID, rsp.Wait, rsp.SID, bdy, rsp, s.UnregisterRequest()).
+			SetContext(r.Context())
 		err = s.Process(req)
 		if err != nil {
-			b := BadRequest.WriteBytes()
-			rw.Write(b)
+			h.terminate(rw, err, legacy)
+			h.r.Remove(rsp.SID)
 			return
 		}
 		log.Printf("%s", rsp.TransformElement())
 
-		req.Handle(rw)
+		req.Handle(h.writer(rw, r, s))
 		return
 	}
 
@@ -121,27 +261,109 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	// If a session does not exist for the session id, return a session not
 	// found error.
 	s, err := h.r.Lookup(bdy.SID)
+	if oe, ok := err.(*OwnerError); ok {
+		h.redirect(rw, r, b, oe)
+		return
+	}
 	if err != nil {
-		b := BadRequest.WriteBytes()
-		rw.Write(b)
+		h.terminate(rw, ErrItemNotFound, legacy)
 		return
 	}
+	rw.Header().Set("Content-Type", s.ContentType())
+	// If the client is adding a stream, name it so the response can tell the
+	// client the name of the new stream. The session creates the stream once
+	// the request has been processed.
+	sr, ok := h.streamRegister()
+	if ok && s.adding(bdy) {
+		if _, ok := h.domain(bdy.To); !ok {
+			log.Println("Add stream request for unknown host ", bdy.To)
+			h.terminate(rw, ErrHostUnknown, s.Legacy())
+			s.Terminate(ErrHostUnknown)
+			h.r.Remove(bdy.SID)
+			return
+		}
+		rsp.Stream = xmpp.StreamID()
+		rsp.From = bdy.To
+	}
 	// Transform the body element into a Body and invoke the process method
 	// of the stream with the Request.
 	// Invoke the Handle method of the request.
-	req := NewRequest(bdy.RID, s.Wait(), bdy.SID, bdy, rsp, s.UnregisterRequest())
+	req := NewRequest(bdy.RID, s.Wait(), bdy.SID, bdy, rsp, s.UnregisterRequest()).
+		SetContext(r.Context())
 	log.Printf("Request to be processed: %+v", req)
 	err = s.Process(req)
+	if err == ErrInvalidKey {
+		// The session is left running for the client that holds the key.
+		h.terminate(rw, err, s.Legacy())
+		return
+	}
 	if err != nil {
-		b := BadRequest.WriteBytes()
-		rw.Write(b)
+		h.terminate(rw, err, s.Legacy())
+		h.r.Remove(bdy.SID)
 		return
 	}
+	if st := req.Stream(); st != nil && sr != nil {
+		log.Println("Adding stream ", st.Name())
+		sr.AddStream(bdy.SID, st)
+	}
 
-	req.Handle(rw)
+	req.Handle(h.writer(rw, r, s))
+	// The client has ended the session, the Session closes itself once the
+	// stream has read the remaining elements.
+	if bdy.Type == "terminate" {
+		log.Println("Removing terminated session.")
+		h.r.Remove(bdy.SID)
+	}
 }
 
-func (h *Handler) negotiate(bdy Body) (rsp Body) {
+// terminate writes the terminate body for err to rw. Errors that are not a
+// *TerminateError are mapped to the closest terminal binding condition. If
+// legacy is true the deprecated HTTP status code for the condition is used.
+func (h *Handler) terminate(rw http.ResponseWriter, err error, legacy bool) {
+	te, ok := err.(*TerminateError)
+	if !ok {
+		switch err {
+		case ErrSessionClosed, ErrSessionNotFound, ErrInvalidKey:
+			te = ErrItemNotFound
+		default:
+			te = ErrUndefinedCondition
+		}
+	}
+	if legacy && te.Status != http.StatusOK {
+		rw.WriteHeader(te.Status)
+	}
+	rw.Write(te.TransformElement().WriteBytes())
+}
+
+// tooLarge rejects a request whose body is larger than the handler's maximum
+// body size.
+func (h *Handler) tooLarge(rw http.ResponseWriter) {
+	rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	rw.Write(ErrBadRequest.TransformElement().WriteBytes())
+}
+
+// writer returns the writer for the response to r. The response is compressed
+// using an encoding accepted by the session or by the request's
+// Accept-Encoding header. Since the response depends on the Accept-Encoding
+// header it is marked as varying with it whenever compression is enabled.
+func (h *Handler) writer(rw http.ResponseWriter, r *http.Request, s *Session) http.ResponseWriter {
+	if h.compress >= 0 {
+		rw.Header().Add("Vary", "Accept-Encoding")
+	}
+	return compressWriter{
+		ResponseWriter: rw,
+		encoding:       encoding(s.accept, r.Header.Get("Accept-Encoding")),
+		threshold:      h.compress,
+	}
+}
+
+// domain returns the domain requested by to and whether it is served by the
+// handler. If to is empty the handler's server is requested.
+func (h *Handler) domain(to string) (string, bool) {
+	return xmpp.Domain(to, h.server, h.hosts)
+}
+
+func (h *Handler) negotiate(bdy Body, domain string) (rsp Body) {
 	var dflt = h.dflt
 	rsp.SID = h.sessionID()
 	rsp.Wait = bdy.Wait
@@ -149,8 +371,14 @@ func (h *Handler) negotiate(bdy Body) (rsp Body) {
 		rsp.Wait = dflt.Wait
 	}
 
-	rsp.Requests = bdy.Hold + 1
-	if bdy.Hold+1 > dflt.Requests {
+	// A client that does not send hold gets the default.
+	hold := bdy.Hold
+	if hold < 0 {
+		hold = dflt.Hold
+	}
+
+	rsp.Requests = hold + 1
+	if hold+1 > dflt.Requests {
 		rsp.Requests = dflt.Requests
 	}
 
@@ -158,15 +386,21 @@ func (h *Handler) negotiate(bdy Body) (rsp Body) {
 	rsp.Polling = dflt.Polling
 	rsp.Inactivity = dflt.Inactivity
 
-	rsp.Hold = bdy.Hold
-	if bdy.Hold > dflt.Hold && dflt.HoldSet {
+	rsp.Hold = hold
+	if hold > dflt.Hold && dflt.HoldSet {
 		rsp.Hold = dflt.Hold
 	}
+	// The client must be able to make a request while the server is holding
+	// the maximum number of requests. A hold of 0 creates a polling session.
+	if rsp.Requests > 0 && rsp.Hold >= rsp.Requests {
+		rsp.Hold = rsp.Requests - 1
+	}
 	rsp.HoldSet = true
 
-	rsp.To = h.server
+	rsp.To = domain
 	rsp.Ack = bdy.RID
 	rsp.MaxPause = dflt.MaxPause
+	rsp.Accept = strings.Join(encodings, ",")
 
 	rsp.RestartLogic = dflt.RestartLogic
 	rsp.XMPPVer = bdy.XMPPVer.Compare(dflt.XMPPVer)
@@ -174,69 +408,7 @@ func (h *Handler) negotiate(bdy Body) (rsp Body) {
 }
 
 func (h *Handler) createElement(start xml.StartElement, dec *xml.Decoder) (el element.Element, err error) {
-	ns := make(map[string]string)
-	return h.childElementsHelper(start, dec, ns)
-}
-
-func (h *Handler) childElementsHelper(start xml.StartElement, dec *xml.Decoder, ns map[string]string) (el element.Element, err error) {
-	var children []element.Token
-
-	el = element.Element{
-		Space:      start.Name.Space,
-		Tag:        start.Name.Local,
-		Namespaces: ns,
-	}
-	for _, attr := range start.Attr {
-		el.Attr = append(
-			el.Attr,
-			element.Attr{
-				Space: attr.Name.Space,
-				Key:   attr.Name.Local,
-				Value: attr.Value,
-			},
-		)
-
-		if el.Space == "" && attr.Name.Space == "" && attr.Name.Local == "xmlns" {
-			el.Namespaces[""] = attr.Value
-		}
-
-		if attr.Name.Space == "xmlns" && el.Space == attr.Name.Local {
-			el.Namespaces[attr.Name.Local] = attr.Value
-		}
-	}
-
-	nns := make(map[string]string)
-	for k, v := range el.Namespaces {
-		nns[k] = v
-	}
-	children, err = h.childElements(dec, nns)
-	el.Child = children
-	return
-}
-
-func (h *Handler) childElements(dec *xml.Decoder, ns map[string]string) (children []element.Token, err error) {
-	var token xml.Token
-	var el element.Element
-	for {
-		token, err = dec.RawToken()
-		if err != nil {
-			return
-		}
-
-		switch elem := token.(type) {
-		case xml.StartElement:
-			el, err = h.childElementsHelper(elem, dec, ns)
-			if err != nil {
-				return
-			}
-			children = append(children, el)
-		case xml.EndElement:
-			return
-		case xml.CharData:
-			data := string(elem)
-			children = append(children, element.CharData{Data: data})
-		}
-	}
+	return xmpp.DecodeElement(start, dec)
 }
 
 // sessionID generates a unique ID for the session.
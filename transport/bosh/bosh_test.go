@@ -0,0 +1,283 @@
+package bosh
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/stream"
+)
+
+// mapRegister is a Register that keeps its sessions in a map.
+type mapRegister struct {
+	sessions map[string]*Session
+	sync.Mutex
+}
+
+func (r *mapRegister) Add(sid string, s *Session) {
+	r.Lock()
+	defer r.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]*Session)
+	}
+	r.sessions[sid] = s
+}
+
+func (r *mapRegister) Remove(sid string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.sessions, sid)
+}
+
+func (r *mapRegister) Lookup(sid string) (*Session, error) {
+	r.Lock()
+	defer r.Unlock()
+	s, ok := r.sessions[sid]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// streamRegister is a mapRegister that supports multiple streams. It starts
+// the stream of each session and added stream.
+type streamRegister struct {
+	mapRegister
+}
+
+func (r *streamRegister) Add(sid string, s *Session) {
+	r.mapRegister.Add(sid, s)
+	go NewTransport(stream.Receiving, s).Start(stream.Properties{Domain: s.Domain()})
+}
+
+func (r *streamRegister) AddStream(sid string, st *Stream) {
+	go NewStreamTransport(stream.Receiving, st).Start(stream.Properties{Domain: st.To()})
+}
+
+func TestHandlerterminate(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		err    error
+		legacy bool
+		status int
+		body   []byte
+		msg    string
+	}{
+		{
+			err:    ErrPolicyViolation,
+			status: http.StatusOK,
+			body:   ErrPolicyViolation.TransformElement().WriteBytes(),
+			msg:    "Should write the terminate body with 200 OK",
+		},
+		{
+			err:    ErrPolicyViolation,
+			legacy: true,
+			status: http.StatusForbidden,
+			body:   ErrPolicyViolation.TransformElement().WriteBytes(),
+			msg:    "Should use the deprecated status code for legacy clients",
+		},
+		{
+			err:    ErrSessionNotFound,
+			status: http.StatusOK,
+			body:   ErrItemNotFound.TransformElement().WriteBytes(),
+			msg:    "Should map ErrSessionNotFound to item-not-found",
+		},
+		{
+			err:    ErrSessionClosed,
+			status: http.StatusOK,
+			body:   ErrItemNotFound.TransformElement().WriteBytes(),
+			msg:    "Should map ErrSessionClosed to item-not-found",
+		},
+		{
+			err:    errors.New("foo"),
+			status: http.StatusOK,
+			body:   ErrUndefinedCondition.TransformElement().WriteBytes(),
+			msg:    "Should map unknown errors to undefined-condition",
+		},
+	}
+	h := new(Handler)
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.terminate(rec, test.err, test.legacy)
+		if rec.Code != test.status {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%d\nGot :%d", test.status, rec.Code)
+		}
+		if !reflect.DeepEqual(test.body, rec.Body.Bytes()) {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%s\nGot :%s", test.body, rec.Body.Bytes())
+		}
+	}
+}
+
+func TestHandlernegotiate(t *testing.T) {
+	t.Parallel()
+
+	var dflt = Body{
+		Wait:     45 * time.Second,
+		Requests: 2,
+		Polling:  5 * time.Second,
+		Hold:     1,
+		HoldSet:  true,
+	}
+	var tests = []struct {
+		hold, requests, wantHold int
+		msg                      string
+	}{
+		{hold: 1, requests: 2, wantHold: 1, msg: "Should use the requested hold"},
+		{hold: -1, requests: 2, wantHold: 1, msg: "Should use the default hold if hold is not set"},
+		{hold: 5, requests: 2, wantHold: 1, msg: "Should cap the hold at the default"},
+		{hold: 0, requests: 1, wantHold: 0, msg: "Should create a polling session for a hold of 0"},
+	}
+	h := NewHandler(nil, BodyTransformer{}, dflt, "localhost")
+	for _, test := range tests {
+		rsp := h.negotiate(Body{Hold: test.hold, Wait: 60 * time.Second}, "localhost")
+		if rsp.Hold != test.wantHold || rsp.Requests != test.requests {
+			t.Error(test.msg)
+			t.Errorf("\nWant:hold=%d requests=%d\nGot :hold=%d requests=%d",
+				test.wantHold, test.requests, rsp.Hold, rsp.Requests)
+		}
+		if rsp.Polling != dflt.Polling {
+			t.Error("Should send the polling interval")
+		}
+		if rsp.To != "localhost" {
+			t.Error("Should send the requested domain")
+		}
+		if rsp.Accept != "gzip,deflate" {
+			t.Error("Should send the supported content encodings")
+		}
+	}
+
+	// Should keep hold below requests
+	h = NewHandler(nil, BodyTransformer{}, Body{Requests: 2, Hold: 3, HoldSet: true}, "localhost")
+	rsp := h.negotiate(Body{Hold: 3}, "localhost")
+	if rsp.Hold != 1 || rsp.Requests != 2 {
+		t.Error("Should keep hold below requests")
+		t.Errorf("\nWant:hold=%d requests=%d\nGot :hold=%d requests=%d", 1, 2, rsp.Hold, rsp.Requests)
+	}
+}
+
+func TestHandlerdomain(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		h      *Handler
+		to     string
+		domain string
+		ok     bool
+		msg    string
+	}{
+		{
+			h: NewHandler(nil, BodyTransformer{}, Body{}, "localhost"), to: "",
+			domain: "localhost", ok: true,
+			msg: "Should use the server if no domain is requested",
+		},
+		{
+			h: NewHandler(nil, BodyTransformer{}, Body{}, "localhost"), to: "example.com",
+			domain: "example.com", ok: false,
+			msg: "Should only serve the server if no domains are set",
+		},
+		{
+			h:  NewHandler(nil, BodyTransformer{}, Body{}, "localhost").ServeDomains("example.com", "example.net"),
+			to: "example.net", domain: "example.net", ok: true,
+			msg: "Should serve the given domains",
+		},
+		{
+			h:  NewHandler(nil, BodyTransformer{}, Body{}, "localhost").ServeDomains("example.com"),
+			to: "example.org", domain: "example.org", ok: false,
+			msg: "Should not serve unknown domains",
+		},
+		{
+			h: NewHandler(nil, BodyTransformer{}, Body{}, "localhost").
+				ResolveDomains(func(domain string) bool { return strings.HasSuffix(domain, ".example.com") }),
+			to: "chat.example.com", domain: "chat.example.com", ok: true,
+			msg: "Should use the resolver to find served domains",
+		},
+	}
+	for _, test := range tests {
+		domain, ok := test.h.domain(test.to)
+		if domain != test.domain || ok != test.ok {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%s %t\nGot :%s %t", test.domain, test.ok, domain, ok)
+		}
+	}
+}
+
+func TestHandlerServeHTTPHostUnknown(t *testing.T) {
+	t.Parallel()
+
+	// Should terminate session creation for an unknown host with host-unknown
+	h := NewHandler(nil, BodyTransformer{}, Body{}, "localhost").ServeDomains("example.com")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='1' to='example.org' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`))
+	h.ServeHTTP(rec, req)
+	want := ErrHostUnknown.TransformElement().WriteBytes()
+	if !reflect.DeepEqual(want, rec.Body.Bytes()) {
+		t.Error("Should terminate session creation for an unknown host with host-unknown")
+		t.Errorf("\nWant:%s\nGot :%s", want, rec.Body.Bytes())
+	}
+}
+
+func TestHandlerServeHTTPAddStreamHostUnknown(t *testing.T) {
+	t.Parallel()
+
+	reg := new(streamRegister)
+	dflt := Body{Wait: 2 * time.Second, Requests: 2, Hold: 1, HoldSet: true, Inactivity: 10 * time.Second}
+	h := NewHandler(reg, BodyTransformer{}, dflt, "localhost")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='1' wait='2' hold='1' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	var sid string
+	var s *Session
+	reg.Lock()
+	for id, ss := range reg.sessions {
+		sid, s = id, ss
+	}
+	reg.Unlock()
+	if s == nil {
+		t.Fatal("Could not create session")
+	}
+
+	held := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(held, httptest.NewRequest("POST", "/", strings.NewReader(
+			`<body rid='2' sid='`+sid+`' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+		close(done)
+	}()
+	transporttest.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.held) != 0
+	})
+
+	// Should terminate held requests with host-unknown
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='3' sid='`+sid+`' to='example.org' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	want := ErrHostUnknown.TransformElement().WriteBytes()
+	if !reflect.DeepEqual(want, rec.Body.Bytes()) {
+		t.Error("Should answer the request with host-unknown")
+		t.Errorf("\nWant:%s\nGot :%s", want, rec.Body.Bytes())
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Should answer the held request")
+	}
+	if !strings.Contains(held.Body.String(), "condition='host-unknown'") {
+		t.Error("Should terminate held requests with host-unknown")
+		t.Errorf("\nGot :%s", held.Body.String())
+	}
+	if _, err := reg.Lookup(sid); err != ErrSessionNotFound {
+		t.Error("Should remove the session")
+		t.Errorf("\nWant:%s\nGot :%v", ErrSessionNotFound, err)
+	}
+}
@@ -0,0 +1,535 @@
+package bosh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/xmpp"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/stream"
+)
+
+// ErrSessionOpen is the error returned when Open is called on a Client that
+// already has a session.
+var ErrSessionOpen = errors.New("bosh: session already open")
+
+// ErrNotBody is the error returned when a connection manager responds with
+// something other than a body element.
+var ErrNotBody = errors.New("bosh: response is not a body element")
+
+const (
+	// defaultRetries is the number of times a failed request is sent again
+	// before the session is ended.
+	defaultRetries = 3
+	// defaultBackoff is how long the client waits before sending a failed
+	// request again for the first time. The wait doubles with each retry up
+	// to maxBackoff.
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+	// timeoutMargin is how much longer than the negotiated wait the client
+	// waits for a response before the request is considered failed.
+	timeoutMargin = 10 * time.Second
+)
+
+// StatusError is the error returned when a connection manager responds with an
+// HTTP status other than 200 OK. Legacy connection managers report terminal
+// conditions this way.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "bosh: unexpected status " + e.Status
+}
+
+// temporary returns true if the status may be caused by an intermediary and
+// the request can be sent again.
+func (e *StatusError) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// A Client is the initiating side of a BOSH session. It creates a session with
+// a connection manager over HTTP, keeps the negotiated number of requests
+// open so the connection manager can send elements at any time, and sends
+// the elements written to it with the next request.
+//
+// Requests that fail because of a network error are sent again with the same
+// RID and body, which the connection manager answers with the response it
+// already sent if it received the request. The client waits between attempts
+// with an exponential backoff. Unless an HTTP client has been set, the client
+// keeps a pool of keep-alive connections sized to the number of requests the
+// connection manager allows.
+//
+// When the session ends the error it ended with is returned from Element, and
+// so from the Next method of its Transport. Sessions terminated by the
+// connection manager return a *TerminateError for the condition.
+//
+// A Client is used as a stream.Transport through NewClientTransport.
+type Client struct {
+	url string
+	// http is the client requests are made with. If pooled is true the
+	// client was created by the Client for the session.
+	http    *http.Client
+	pooled  bool
+	retries int
+	backoff time.Duration
+	bt      BodyTransformer
+	// dflt is the body of the session creation request. It holds the
+	// parameters the client requests, such as wait and hold.
+	dflt Body
+
+	// rid is the RID of the last request sent. The connection manager's
+	// parameters for the session are those of the session creation response.
+	rid        int
+	sid        string
+	domain     string
+	wait       time.Duration
+	hold       int
+	requests   int
+	polling    time.Duration
+	inflight   int
+	polled     time.Time
+	pending    []element.Element
+	restarting bool
+	closing    bool
+
+	// received are the elements received from the connection manager that
+	// have not been read. notify is signalled when elements are received and
+	// wake when the client may need to send a request.
+	received []element.Element
+	notify   chan struct{}
+	wake     chan struct{}
+	// err is the reason the session ended, exit is closed once it has.
+	err  error
+	exit chan struct{}
+	lock sync.Mutex
+}
+
+// NewClient creates a Client for the connection manager at url. The session
+// creation request is built from dflt, which should set the wait and hold the
+// client would like. If the versions are not set, version 1.6 of BOSH and 1.0
+// of XMPP over BOSH are requested.
+func NewClient(url string, dflt Body) *Client {
+	c := new(Client)
+	c.url = url
+	c.http = pool(0, 0)
+	c.pooled = true
+	c.retries = defaultRetries
+	c.backoff = defaultBackoff
+	c.bt = NewBodyTransformer(Body{})
+	c.dflt = dflt
+	c.notify = make(chan struct{}, 1)
+	c.wake = make(chan struct{}, 1)
+	c.exit = make(chan struct{})
+	return c
+}
+
+// HTTPClient sets the client used to make requests to the connection
+// manager. By default the Client keeps its own pool of connections, sized to
+// the number of requests the connection manager allows.
+func (c *Client) HTTPClient(hc *http.Client) *Client {
+	c.http = hc
+	c.pooled = false
+	return c
+}
+
+// Retry sets the number of times a failed request is sent again and how long
+// the client waits before the first retry. The wait doubles with each retry.
+// By default a request is retried 3 times, starting after half a second.
+func (c *Client) Retry(retries int, backoff time.Duration) *Client {
+	c.retries = retries
+	c.backoff = backoff
+	return c
+}
+
+// SID returns the session ID, it is empty until the session has been opened.
+func (c *Client) SID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sid
+}
+
+// Open creates a session for the given domain. The elements included in the
+// session creation response can be read with Element.
+func (c *Client) Open(domain string) error {
+	c.lock.Lock()
+	if c.sid != "" || c.closing {
+		c.lock.Unlock()
+		return ErrSessionOpen
+	}
+	c.domain = domain
+	c.rid = initialRID()
+	b := c.dflt
+	b.To = domain
+	b.RID = c.rid
+	b.HoldSet = true
+	if b.Ver == (Version{}) {
+		b.Ver = Version{Major: 1, Minor: 6}
+	}
+	if b.XMPPVer == (Version{}) {
+		b.XMPPVer = Version{Major: 1, Minor: 0}
+	}
+	c.lock.Unlock()
+
+	rsp, err := c.post(b)
+	if err != nil {
+		return err
+	}
+	if rsp.Type == "terminate" {
+		if err := terminateError(rsp); err != nil {
+			return err
+		}
+		return stream.ErrStreamClosed
+	}
+	if rsp.SID == "" {
+		return ErrNotBody
+	}
+	c.lock.Lock()
+	c.sid = rsp.SID
+	c.wait = rsp.Wait
+	c.hold = rsp.Hold
+	c.requests = rsp.Requests
+	if c.requests == 0 {
+		c.requests = c.hold + 1
+	}
+	c.polling = rsp.Polling
+	c.polled = time.Now()
+	if c.pooled {
+		old := c.http
+		c.http = pool(c.requests, c.wait)
+		old.Transport.(*http.Transport).CloseIdleConnections()
+	}
+	c.lock.Unlock()
+	c.receive(rsp.Children)
+	go c.run()
+	return nil
+}
+
+// Restart asks the connection manager to restart the stream, which the client
+// must do after authenticating. Elements written before the restart are sent
+// once the restart request has been sent.
+func (c *Client) Restart() {
+	c.lock.Lock()
+	c.restarting = true
+	c.lock.Unlock()
+	c.signal(c.wake)
+}
+
+// Write queues el to be sent to the connection manager with the next request.
+func (c *Client) Write(el element.Element) error {
+	c.lock.Lock()
+	if c.closing {
+		c.lock.Unlock()
+		return stream.ErrStreamClosed
+	}
+	c.pending = append(c.pending, el)
+	c.lock.Unlock()
+	c.signal(c.wake)
+	return nil
+}
+
+// Element returns the next element received from the connection manager.
+// Once the session has ended the remaining elements are returned, followed by
+// the error the session ended with.
+func (c *Client) Element() (element.Element, error) {
+	for {
+		c.lock.Lock()
+		if len(c.received) > 0 {
+			el := c.received[0]
+			c.received = c.received[1:]
+			c.lock.Unlock()
+			return el, nil
+		}
+		c.lock.Unlock()
+		select {
+		case <-c.notify:
+		case <-c.exit:
+			c.lock.Lock()
+			n, err := len(c.received), c.err
+			c.lock.Unlock()
+			if n == 0 {
+				return element.Element{}, err
+			}
+		}
+	}
+}
+
+// Close terminates the session. Elements that have been written but not sent
+// are included in the terminate request.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	if c.closing {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closing = true
+	if c.sid == "" {
+		c.lock.Unlock()
+		c.end(stream.ErrStreamClosed)
+		return nil
+	}
+	c.rid++
+	b := Body{SID: c.sid, RID: c.rid, Type: "terminate", Children: c.pending}
+	c.pending = nil
+	c.lock.Unlock()
+	_, err := c.post(b)
+	c.end(stream.ErrStreamClosed)
+	return err
+}
+
+// run sends requests to the connection manager until the session ends.
+func (c *Client) run() {
+	for {
+		c.lock.Lock()
+		for c.ready(time.Now()) {
+			b := c.next()
+			c.inflight++
+			go c.send(b)
+		}
+		var poll <-chan time.Time
+		if c.hold == 0 && c.inflight == 0 && !c.closing {
+			poll = time.After(c.polled.Add(c.polling).Sub(time.Now()))
+		}
+		c.lock.Unlock()
+		select {
+		case <-c.exit:
+			return
+		case <-c.wake:
+		case <-poll:
+		}
+	}
+}
+
+// ready returns true if a request should be sent. Requests are sent as long as
+// there is something to send and fewer than the negotiated number of requests
+// are open. Empty requests are sent to keep hold requests open, or in a
+// polling session, once the polling interval has passed.
+func (c *Client) ready(now time.Time) bool {
+	if c.closing || c.inflight >= c.requests {
+		return false
+	}
+	if c.restarting || len(c.pending) > 0 {
+		return true
+	}
+	if c.hold == 0 {
+		return c.inflight == 0 && !now.Before(c.polled.Add(c.polling))
+	}
+	return c.inflight < c.hold
+}
+
+// next returns the body of the next request. A restart request carries no
+// payload, the elements written before it are sent with the request after it.
+func (c *Client) next() Body {
+	c.rid++
+	b := Body{SID: c.sid, RID: c.rid}
+	switch {
+	case c.restarting:
+		b.To = c.domain
+		b.Lang = c.dflt.Lang
+		b.Restart = true
+		c.restarting = false
+	case len(c.pending) > 0:
+		b.Children = c.pending
+		c.pending = nil
+	default:
+		c.polled = time.Now()
+	}
+	return b
+}
+
+// send sends the request b and handles the response.
+func (c *Client) send(b Body) {
+	rsp, err := c.post(b)
+	c.lock.Lock()
+	c.inflight--
+	c.lock.Unlock()
+	if err != nil {
+		log.Println("BOSH request failed ", err)
+		c.end(err)
+		return
+	}
+	c.receive(rsp.Children)
+	if rsp.Type == "terminate" {
+		if err := terminateError(rsp); err != nil {
+			c.end(err)
+			return
+		}
+		c.end(stream.ErrStreamClosed)
+		return
+	}
+	c.signal(c.wake)
+}
+
+// post sends b to the connection manager and returns the response. If the
+// request fails it is sent again, with the same RID and body, until it
+// succeeds or the retries have been used up.
+func (c *Client) post(b Body) (Body, error) {
+	data := b.TransformElement().WriteBytes()
+	c.lock.Lock()
+	hc := c.http
+	c.lock.Unlock()
+	for attempt := 0; ; attempt++ {
+		rsp, err := c.do(hc, data)
+		if err == nil || attempt >= c.retries || !retryable(err) {
+			return rsp, err
+		}
+		log.Printf("Retrying request %d after error: %s", b.RID, err)
+		select {
+		case <-c.exit:
+			return Body{}, err
+		case <-time.After(c.delay(attempt)):
+		}
+	}
+}
+
+// do makes a single request with the body data and returns the response.
+func (c *Client) do(hc *http.Client, data []byte) (Body, error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return Body{}, err
+	}
+	req.Header.Set("Content-Type", defaultContentType)
+	rsp, err := hc.Do(req)
+	if err != nil {
+		return Body{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return Body{}, &StatusError{StatusCode: rsp.StatusCode, Status: rsp.Status}
+	}
+	data, err = ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return Body{}, err
+	}
+	return c.parse(data)
+}
+
+// delay returns how long to wait before the retry following the given
+// attempt.
+func (c *Client) delay(attempt int) time.Duration {
+	d := c.backoff
+	for i := 0; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// retryable returns true if a request that failed with err can be sent again.
+// Responses that were received but could not be parsed are not retried, the
+// connection manager would send the same response again.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.temporary()
+	case *xml.SyntaxError:
+		return false
+	}
+	return err != ErrNotBody
+}
+
+// pool returns an HTTP client with a pool of keep-alive connections for up to
+// requests concurrent requests that are held for up to wait. The pool has one
+// more connection, since a client may make one request beyond the limit to
+// pause or terminate the session. A requests of 0 does not limit the number of
+// connections.
+func pool(requests int, wait time.Duration) *http.Client {
+	var size int
+	if requests > 0 {
+		size = requests + 1
+	}
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: size,
+		MaxConnsPerHost:     size,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	hc := &http.Client{Transport: tr}
+	if wait > 0 {
+		hc.Timeout = wait + timeoutMargin
+	}
+	return hc
+}
+
+// parse returns the body encoded in data.
+func (c *Client) parse(data []byte) (Body, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := dec.RawToken()
+		if err != nil {
+			return Body{}, err
+		}
+		switch start := token.(type) {
+		case xml.StartElement:
+			if start.Name.Local != "body" {
+				return Body{}, ErrNotBody
+			}
+			el, err := xmpp.DecodeElement(start, dec)
+			if err != nil {
+				return Body{}, err
+			}
+			return c.bt.TransformBody(el), nil
+		case xml.ProcInst, xml.CharData, xml.Comment:
+		default:
+			return Body{}, ErrNotBody
+		}
+	}
+}
+
+// receive queues the elements received from the connection manager.
+func (c *Client) receive(els []element.Element) {
+	if len(els) == 0 {
+		return
+	}
+	c.lock.Lock()
+	c.received = append(c.received, els...)
+	c.lock.Unlock()
+	c.signal(c.notify)
+}
+
+// end ends the session with err. Calls after the first have no effect.
+func (c *Client) end(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.exit:
+		return
+	default:
+	}
+	c.closing = true
+	c.err = err
+	close(c.exit)
+}
+
+// signal signals ch without blocking. The channels have a buffer of one, so a
+// signal is never lost.
+func (c *Client) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// initialRID returns a random RID for a session creation request. It is
+// small enough that the client can make many requests before the RID reaches
+// 2^53, as required by XEP-0124.
+func initialRID() int {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return int(binary.BigEndian.Uint32(b)>>1) + 1
+}
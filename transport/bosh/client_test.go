@@ -0,0 +1,253 @@
+package bosh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/stream"
+)
+
+// newEchoServer returns a server for sessions that run an echo stream.
+func newEchoServer() (*httptest.Server, *MemoryRegister) {
+	reg := NewMemoryRegister(transporttest.EchoStream, 0)
+	h := NewHandler(reg, NewBodyTransformer(Body{}), Body{
+		Wait:       2 * time.Second,
+		Hold:       1,
+		HoldSet:    true,
+		Requests:   2,
+		Inactivity: 10 * time.Second,
+		Ver:        Version{Major: 1, Minor: 6},
+		XMPPVer:    Version{Major: 1, Minor: 0},
+	}, "localhost")
+	return httptest.NewServer(h), reg
+}
+
+func TestClientTransport(t *testing.T) {
+	t.Parallel()
+
+	srv, reg := newEchoServer()
+	defer srv.Close()
+	tp := NewClientTransport(NewClient(srv.URL, Body{Wait: 2 * time.Second, Hold: 1}))
+
+	transporttest.EchoClient(t, tp, "localhost")
+	if reg.Len() != 1 {
+		t.Error("Should create a session")
+	}
+
+	// Should terminate the session when closed
+	if err := tp.Close(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := tp.Next(); err != stream.ErrStreamClosed {
+		t.Error("Should end the stream when closed")
+		t.Errorf("\nWant:%s\nGot :%v", stream.ErrStreamClosed, err)
+	}
+	transporttest.Eventually(t, func() bool { return reg.Len() == 0 })
+}
+
+func TestClientOpen(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newEchoServer()
+	defer srv.Close()
+
+	// Should return the condition of a refused session
+	c := NewClient(srv.URL, Body{Wait: time.Second, Hold: 1})
+	if err := c.Open("example.com"); err != ErrHostUnknown {
+		t.Error("Should return the condition of a refused session")
+		t.Errorf("\nWant:%s\nGot :%v", ErrHostUnknown, err)
+	}
+	c.Close()
+}
+
+func TestClientready(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	var tests = []struct {
+		c    *Client
+		want bool
+		msg  string
+	}{
+		{&Client{hold: 1, requests: 2}, true, "Should keep hold requests open"},
+		{&Client{hold: 1, requests: 2, inflight: 1}, false, "Should not send empty requests beyond hold"},
+		{&Client{hold: 1, requests: 2, inflight: 1, pending: []element.Element{element.New("a")}},
+			true, "Should send pending elements"},
+		{&Client{hold: 1, requests: 2, inflight: 2, pending: []element.Element{element.New("a")}},
+			false, "Should not exceed the negotiated requests"},
+		{&Client{hold: 1, requests: 2, inflight: 1, restarting: true}, true, "Should send restarts"},
+		{&Client{hold: 1, requests: 2, closing: true}, false, "Should not send requests once closing"},
+		{&Client{requests: 1, polling: time.Second, polled: now}, false,
+			"Should wait for the polling interval"},
+		{&Client{requests: 1, polling: time.Second, polled: now.Add(-time.Second)}, true,
+			"Should poll once the polling interval has passed"},
+	}
+	for _, test := range tests {
+		if got := test.c.ready(now); got != test.want {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%t\nGot :%t", test.want, got)
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	t.Parallel()
+
+	reg := NewMemoryRegister(transporttest.EchoStream, 0)
+	h := NewHandler(reg, NewBodyTransformer(Body{}), Body{
+		Wait:       2 * time.Second,
+		Hold:       1,
+		HoldSet:    true,
+		Requests:   2,
+		Inactivity: 10 * time.Second,
+	}, "localhost")
+	var lock sync.Mutex
+	var dropped bool
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		lock.Lock()
+		bodies = append(bodies, string(b))
+		drop := !dropped && strings.Contains(string(b), "<message")
+		if drop {
+			dropped = true
+		}
+		lock.Unlock()
+		if !drop {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		// The request is processed but the connection is dropped before the
+		// response reaches the client.
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	// Should send a failed request again with the same RID and body
+	c := NewClient(srv.URL, Body{Wait: 2 * time.Second, Hold: 1}).Retry(3, time.Millisecond)
+	tp := NewClientTransport(c)
+	if _, err := tp.Start(stream.Properties{Domain: "localhost"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := tp.WriteElement(element.New("message")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	el, err := tp.Next()
+	if err != nil || el.Tag != "message" {
+		t.Error("Should receive the response to a retried request")
+		t.Errorf("\nGot :%s %v", el, err)
+	}
+	lock.Lock()
+	var sent int
+	for _, b := range bodies {
+		if strings.Contains(b, "<message") {
+			sent++
+		}
+	}
+	lock.Unlock()
+	if sent != 2 {
+		t.Error("Should send a failed request again with the same RID and body")
+		t.Errorf("\nWant:%d\nGot :%d", 2, sent)
+	}
+	tp.Close()
+
+	// Should give up once the retries have been used up
+	var attempts int
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	c = NewClient(unavailable.URL, Body{Wait: time.Second, Hold: 1}).Retry(2, time.Millisecond)
+	err = c.Open("localhost")
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Should give up once the retries have been used up")
+		t.Errorf("\nGot :%v", err)
+	}
+	lock.Lock()
+	if attempts != 3 {
+		t.Error("Should retry the request the given number of times")
+		t.Errorf("\nWant:%d\nGot :%d", 3, attempts)
+	}
+	lock.Unlock()
+}
+
+func TestClientTerminated(t *testing.T) {
+	t.Parallel()
+
+	srv, reg := newEchoServer()
+	defer srv.Close()
+	tp := NewClientTransport(NewClient(srv.URL, Body{Wait: 2 * time.Second, Hold: 1}))
+	if _, err := tp.Start(stream.Properties{Domain: "localhost"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Should return the condition the connection manager terminated with
+	reg.Range(func(sid string, s *Session) bool {
+		s.Terminate(ErrPolicyViolation)
+		return true
+	})
+	if _, err := tp.Next(); err != ErrPolicyViolation {
+		t.Error("Should return the condition the connection manager terminated with")
+		t.Errorf("\nWant:%s\nGot :%v", ErrPolicyViolation, err)
+	}
+	if err := tp.WriteElement(element.New("message")); err != stream.ErrStreamClosed {
+		t.Error("Should not write to a terminated session")
+	}
+}
+
+func TestClientdelay(t *testing.T) {
+	t.Parallel()
+
+	c := &Client{backoff: time.Second}
+	var tests = []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, maxBackoff},
+	}
+	for _, test := range tests {
+		if got := c.delay(test.attempt); got != test.want {
+			t.Errorf("Should back off exponentially up to %s", maxBackoff)
+			t.Errorf("\nWant:%s\nGot :%s", test.want, got)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		requests int
+		want     int
+		msg      string
+	}{
+		{2, 3, "Should leave a connection for a pause or terminate request"},
+		{0, 0, "Should not limit the connections if requests is not limited"},
+	}
+	for _, test := range tests {
+		tr := pool(test.requests, time.Second).Transport.(*http.Transport)
+		if tr.MaxConnsPerHost != test.want || tr.MaxIdleConnsPerHost != test.want {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%d\nGot :%d %d", test.want, tr.MaxConnsPerHost, tr.MaxIdleConnsPerHost)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package bosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ErrForwardingDisabled is the error returned by a ClusterRegister's Forward
+// method when it has not been given a client to forward requests with.
+var ErrForwardingDisabled = errors.New("request forwarding is disabled")
+
+// forwardedHeader is the header set on requests forwarded to another node. A
+// forwarded request is never forwarded again, so nodes that disagree about
+// the owner of a session cannot forward a request between themselves forever.
+const forwardedHeader = "X-Bosh-Forwarded-By"
+
+// An OwnerError is the error returned by Lookup when a session is owned by
+// another node. Owner is the URL of the owning node's BOSH endpoint.
+type OwnerError struct {
+	SID   string
+	Owner string
+}
+
+func (e *OwnerError) Error() string {
+	return fmt.Sprintf("session %s is owned by %s", e.SID, e.Owner)
+}
+
+// A Store is the shared record of which node owns each session, used by the
+// ClusterRegisters of every node in a cluster. Implementations must be safe
+// for concurrent use.
+type Store interface {
+	// Claim records node as the owner of the session with the given sid.
+	Claim(sid, node string) error
+	// Owner returns the node that owns the session with the given sid. If no
+	// node owns the session ErrSessionNotFound is returned.
+	Owner(sid string) (string, error)
+	// Release removes the record of the session with the given sid if it is
+	// owned by node.
+	Release(sid, node string) error
+}
+
+// A MemoryStore is a Store that keeps its records in memory. It can only be
+// shared by ClusterRegisters in the same process, which makes it useful for
+// tests and for running several nodes within one process.
+type MemoryStore struct {
+	owners map[string]string
+	sync.RWMutex
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{owners: make(map[string]string)}
+}
+
+// Claim implements Store.
+func (m *MemoryStore) Claim(sid, node string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.owners[sid] = node
+	return nil
+}
+
+// Owner implements Store.
+func (m *MemoryStore) Owner(sid string) (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	node, ok := m.owners[sid]
+	if !ok {
+		return "", ErrSessionNotFound
+	}
+	return node, nil
+}
+
+// Release implements Store.
+func (m *MemoryStore) Release(sid, node string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.owners[sid] == node {
+		delete(m.owners, sid)
+	}
+	return nil
+}
+
+// A ClusterRegister is a Register for a node in a cluster of nodes behind a
+// load balancer. Sessions created on the node are kept in a local Register and
+// their ownership is recorded in a Store shared by the cluster. Requests for a
+// session owned by another node are forwarded to it if the register has a
+// client to forward them with, otherwise the client is sent to the owning node
+// with a see-other-uri condition.
+//
+// Clients are only offered multiple streams if the local Register is a
+// StreamRegister.
+type ClusterRegister struct {
+	node   string
+	local  Register
+	store  Store
+	client *http.Client
+}
+
+// NewClusterRegister creates a ClusterRegister for the node whose BOSH
+// endpoint is at the URL node. Sessions are kept in local and their ownership
+// is recorded in store. If local is a SweepingRegister the sessions it removes
+// are released as well.
+func NewClusterRegister(node string, local Register, store Store) *ClusterRegister {
+	c := &ClusterRegister{node: node, local: local, store: store}
+	if sr, ok := local.(SweepingRegister); ok {
+		sr.OnRemove(c.release)
+	}
+	return c
+}
+
+// ForwardWith sets the client used to forward requests to the node that owns
+// their session. If it is nil, which is the default, clients are sent to the
+// owning node instead.
+func (c *ClusterRegister) ForwardWith(client *http.Client) *ClusterRegister {
+	c.client = client
+	return c
+}
+
+// Add adds a session to the local register and claims it for this node.
+func (c *ClusterRegister) Add(sid string, s *Session) {
+	if err := c.store.Claim(sid, c.node); err != nil {
+		log.Println("Could not claim session ", sid, err)
+	}
+	c.local.Add(sid, s)
+}
+
+// AddStream adds a stream to a session in the local register. If the local
+// register is not a StreamRegister the stream is closed.
+func (c *ClusterRegister) AddStream(sid string, st *Stream) {
+	sr, ok := c.local.(StreamRegister)
+	if !ok {
+		log.Println("Closing stream, local register does not support streams")
+		st.Close()
+		return
+	}
+	sr.AddStream(sid, st)
+}
+
+// Remove removes a session from the local register and releases it.
+func (c *ClusterRegister) Remove(sid string) {
+	c.local.Remove(sid)
+	c.release(sid)
+}
+
+// release releases the session with the given sid if it is owned by this
+// node.
+func (c *ClusterRegister) release(sid string) {
+	if err := c.store.Release(sid, c.node); err != nil {
+		log.Println("Could not release session ", sid, err)
+	}
+}
+
+// Lookup returns the session with the given sid from the local register. If
+// the session is owned by another node an *OwnerError is returned.
+func (c *ClusterRegister) Lookup(sid string) (*Session, error) {
+	s, err := c.local.Lookup(sid)
+	if err == nil {
+		return s, nil
+	}
+	owner, serr := c.store.Owner(sid)
+	if serr != nil {
+		return nil, serr
+	}
+	if owner == c.node {
+		// The session has been removed from this node without being
+		// released, for example by a local register that is not a
+		// SweepingRegister.
+		c.release(sid)
+		return nil, err
+	}
+	return nil, &OwnerError{SID: sid, Owner: owner}
+}
+
+// Forward sends the request r, whose decompressed body is body, to the node
+// owner and writes its response to rw. ErrForwardingDisabled is returned if
+// the register does not have a client to forward requests with. If an error
+// is returned nothing has been written to rw.
+func (c *ClusterRegister) Forward(rw http.ResponseWriter, r *http.Request, body []byte, owner string) error {
+	if c.client == nil {
+		return ErrForwardingDisabled
+	}
+	req, err := http.NewRequest("POST", owner, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(r.Context())
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	if accept := r.Header.Get("Accept-Encoding"); accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	req.Header.Set(forwardedHeader, c.node)
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	header := rw.Header()
+	for key, values := range rsp.Header {
+		switch key {
+		case "Connection", "Transfer-Encoding":
+		case "Vary":
+			header[key] = append(header[key], values...)
+		default:
+			header[key] = values
+		}
+	}
+	rw.WriteHeader(rsp.StatusCode)
+	_, err = io.Copy(rw, rsp.Body)
+	if err != nil {
+		log.Println("Could not write forwarded response ", err)
+	}
+	return nil
+}
+
+// redirect handles a request for a session owned by another node. The request
+// is forwarded to the owning node if the register can forward it, otherwise
+// the client is sent to the owning node. Requests that have already been
+// forwarded are answered with item-not-found.
+func (h *Handler) redirect(rw http.ResponseWriter, r *http.Request, body []byte, oe *OwnerError) {
+	if by := r.Header.Get(forwardedHeader); by != "" {
+		log.Printf("Request forwarded by %s for session owned by %s", by, oe.Owner)
+		h.terminate(rw, ErrItemNotFound, false)
+		return
+	}
+	if fr, ok := h.r.(ForwardRegister); ok {
+		err := fr.Forward(rw, r, body, oe.Owner)
+		if err == nil {
+			return
+		}
+		if err != ErrForwardingDisabled {
+			log.Println("Could not forward request ", err)
+			h.terminate(rw, ErrRemoteConnectionFailed, false)
+			return
+		}
+	}
+	h.terminate(rw, SeeOtherURI(oe.Owner), false)
+}
+
+// streamRegister returns the handler's register if it supports multiple
+// streams. A ClusterRegister only supports them if its local register does.
+func (h *Handler) streamRegister() (StreamRegister, bool) {
+	if c, ok := h.r.(*ClusterRegister); ok {
+		if _, ok := c.local.(StreamRegister); !ok {
+			return nil, false
+		}
+	}
+	sr, ok := h.r.(StreamRegister)
+	return sr, ok
+}
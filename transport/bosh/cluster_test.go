@@ -0,0 +1,180 @@
+package bosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skriptble/nine/stream"
+)
+
+// createSession creates a session with h and returns its sid, which is read
+// from reg.
+func createSession(t *testing.T, h *Handler, reg *MemoryRegister) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='1' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	var sid string
+	reg.Range(func(id string, s *Session) bool {
+		sid = id
+		return false
+	})
+	if sid == "" {
+		t.Fatal("Could not create session")
+	}
+	return sid
+}
+
+func TestClusterRegisterLookup(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	a := NewClusterRegister("http://a.example.com/bosh", NewMemoryRegister(nil, 0), store)
+	b := NewClusterRegister("http://b.example.com/bosh", NewMemoryRegister(nil, 0), store)
+	s := NewSessionFromResponse(1, Body{SID: "foobar", Wait: time.Second, Inactivity: 10 * time.Second})
+	defer s.Close()
+	a.Add("foobar", s)
+
+	// Should lookup sessions owned by the node
+	got, err := a.Lookup("foobar")
+	if err != nil || got != s {
+		t.Error("Should lookup sessions owned by the node")
+		t.Errorf("\nGot :%v %s", got, err)
+	}
+
+	// Should return the owner of sessions owned by other nodes
+	_, err = b.Lookup("foobar")
+	want := &OwnerError{SID: "foobar", Owner: "http://a.example.com/bosh"}
+	if !reflect.DeepEqual(want, err) {
+		t.Error("Should return the owner of sessions owned by other nodes")
+		t.Errorf("\nWant:%v\nGot :%v", want, err)
+	}
+
+	// Should release removed sessions
+	a.Remove("foobar")
+	if _, err = b.Lookup("foobar"); err != ErrSessionNotFound {
+		t.Error("Should release removed sessions")
+		t.Errorf("\nWant:%s\nGot :%v", ErrSessionNotFound, err)
+	}
+}
+
+func TestClusterRegisterSweep(t *testing.T) {
+	t.Parallel()
+
+	// Should release sessions the local register removes when they expire
+	store := NewMemoryStore()
+	local := NewMemoryRegister(nil, 0)
+	defer local.Close()
+	c := NewClusterRegister("http://a.example.com/bosh", local, store)
+	c.Add("foobar", &Session{exit: make(chan struct{}), expiry: time.Now().Add(-time.Second)})
+	local.sweep()
+	if _, err := store.Owner("foobar"); err != ErrSessionNotFound {
+		t.Error("Should release sessions the local register removes when they expire")
+		t.Errorf("\nWant:%s\nGot :%v", ErrSessionNotFound, err)
+	}
+
+	// Should release expired sessions removed by a lookup
+	c.Add("bazquux", &Session{expired: true})
+	local.Lookup("bazquux")
+	if _, err := store.Owner("bazquux"); err != ErrSessionNotFound {
+		t.Error("Should release expired sessions removed by a lookup")
+		t.Errorf("\nWant:%s\nGot :%v", ErrSessionNotFound, err)
+	}
+}
+
+func TestHandlerServeHTTPSeeOther(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	localA := NewMemoryRegister(nil, 0)
+	a := NewHandler(NewClusterRegister("http://a.example.com/bosh", localA, store),
+		BodyTransformer{}, Body{}, "localhost")
+	b := NewHandler(NewClusterRegister("http://b.example.com/bosh", NewMemoryRegister(nil, 0), store),
+		BodyTransformer{}, Body{}, "localhost")
+	sid := createSession(t, a, localA)
+
+	// Should send clients to the node that owns the session
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='2' sid='`+sid+`' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	want := SeeOtherURI("http://a.example.com/bosh").TransformElement().WriteBytes()
+	if !reflect.DeepEqual(want, rec.Body.Bytes()) {
+		t.Error("Should send clients to the node that owns the session")
+		t.Errorf("\nWant:%s\nGot :%s", want, rec.Body.Bytes())
+	}
+}
+
+func TestHandlerServeHTTPForward(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	localA := NewMemoryRegister(nil, 0)
+	var a *Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		a.ServeHTTP(rw, r)
+	}))
+	defer srv.Close()
+	a = NewHandler(NewClusterRegister(srv.URL, localA, store), BodyTransformer{}, Body{}, "localhost")
+	b := NewHandler(NewClusterRegister("http://b.example.com/bosh", NewMemoryRegister(nil, 0), store).
+		ForwardWith(srv.Client()), BodyTransformer{}, Body{}, "localhost")
+	sid := createSession(t, a, localA)
+
+	// Should not forward requests that have already been forwarded
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='2' sid='`+sid+`' xmlns='http://jabber.org/protocol/httpbind'/>`))
+	req.Header.Set(forwardedHeader, "http://c.example.com/bosh")
+	b.ServeHTTP(rec, req)
+	want := ErrItemNotFound.TransformElement().WriteBytes()
+	if !reflect.DeepEqual(want, rec.Body.Bytes()) {
+		t.Error("Should not forward requests that have already been forwarded")
+		t.Errorf("\nWant:%s\nGot :%s", want, rec.Body.Bytes())
+	}
+
+	// Should forward requests to the node that owns the session
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='2' sid='`+sid+`' type='terminate' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<body") {
+		t.Error("Should forward requests to the node that owns the session")
+		t.Errorf("\nGot :%d %s", rec.Code, rec.Body.String())
+	}
+	if localA.Len() != 0 {
+		t.Error("Should forward requests to the node that owns the session")
+		t.Errorf("\nWant:%d sessions\nGot :%d sessions", 0, localA.Len())
+	}
+	if _, err := store.Owner(sid); err != ErrSessionNotFound {
+		t.Error("Should release sessions terminated through another node")
+	}
+}
+
+func TestHandlerServeHTTPClusterStreams(t *testing.T) {
+	t.Parallel()
+
+	memory := NewMemoryRegister(func(tp stream.Transport, domain string) {
+		go tp.Start(stream.Properties{Domain: domain})
+	}, 0)
+	defer memory.Close()
+	var tests = []struct {
+		local   Register
+		streams bool
+		msg     string
+	}{
+		{new(mapRegister), false, "Should not offer multiple streams if the local register does not support them"},
+		{memory, true, "Should offer multiple streams if the local register supports them"},
+	}
+	for _, test := range tests {
+		reg := NewClusterRegister("http://node1/bosh", test.local, NewMemoryStore())
+		h := NewHandler(reg, BodyTransformer{}, Body{}, "localhost")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+			`<body rid='1' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+		if got := strings.Contains(rec.Body.String(), " stream="); got != test.streams {
+			t.Error(test.msg)
+			t.Errorf("\nGot :%s", rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package bosh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedEncoding is the error returned when a request body is
+// compressed with a content encoding the Handler does not support.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ErrBodyTooLarge is the error returned when a request body, either as sent or
+// once decompressed, is larger than the Handler's maximum body size.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// defaultMaxBodySize is the largest request body in bytes the Handler reads.
+const defaultMaxBodySize = 1 << 20
+
+// defaultCompressThreshold is the size in bytes above which response bodies
+// are compressed.
+const defaultCompressThreshold = 1024
+
+// encodings are the content encodings supported by the Handler, in order of
+// preference. This is sent as the accept attribute of session creation
+// responses.
+var encodings = []string{"gzip", "deflate"}
+
+// encoding returns the most preferred supported encoding that appears in any
+// of the given lists. The lists are either accept attributes or
+// Accept-Encoding headers, encodings with a quality of 0 are ignored. If none
+// of the supported encodings are accepted an empty string is returned.
+func encoding(accepts ...string) string {
+	accepted := make(map[string]bool)
+	for _, accept := range accepts {
+		for _, coding := range strings.Split(accept, ",") {
+			parts := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if refused(parts[1:]) {
+				continue
+			}
+			accepted[name] = true
+		}
+	}
+	for _, enc := range encodings {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// refused returns true if the parameters of a content coding give it a quality
+// of 0, or a quality that cannot be parsed.
+func refused(params []string) bool {
+	for _, param := range params {
+		param = strings.ToLower(strings.Replace(param, " ", "", -1))
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+		return err != nil || q <= 0
+	}
+	return false
+}
+
+// readAll reads body, which is limited to max bytes. If body is larger, or
+// reading it fails because the request body it reads from is larger,
+// ErrBodyTooLarge is returned.
+func readAll(body io.Reader, max int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, tooLarge(err)
+	}
+	if int64(len(b)) > max {
+		return nil, ErrBodyTooLarge
+	}
+	return b, nil
+}
+
+// tooLarge returns ErrBodyTooLarge if err was caused by reading more than the
+// maximum body size, otherwise err is returned.
+func tooLarge(err error) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return ErrBodyTooLarge
+	}
+	return err
+}
+
+// decompress returns a reader for the decompressed body of r.
+func decompress(r *http.Request) (io.Reader, error) {
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		return gzip.NewReader(r.Body)
+	case "deflate":
+		return zlib.NewReader(r.Body)
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+// compressWriter compresses response bodies larger than threshold with the
+// given encoding before writing them to the underlying ResponseWriter. Each
+// call to Write must contain an entire response body.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding  string
+	threshold int
+}
+
+func (w compressWriter) Write(b []byte) (int, error) {
+	if w.encoding == "" || w.threshold < 0 || len(b) <= w.threshold {
+		return w.ResponseWriter.Write(b)
+	}
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	switch w.encoding {
+	case "gzip":
+		zw = gzip.NewWriter(&buf)
+	case "deflate":
+		zw = zlib.NewWriter(&buf)
+	default:
+		return w.ResponseWriter.Write(b)
+	}
+	if _, err := zw.Write(b); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	w.Header().Set("Content-Encoding", w.encoding)
+	if _, err := w.ResponseWriter.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
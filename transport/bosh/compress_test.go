@@ -0,0 +1,187 @@
+package bosh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncoding(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		accepts []string
+		want    string
+		msg     string
+	}{
+		{[]string{"deflate,gzip"}, "gzip", "Should prefer gzip"},
+		{[]string{"deflate"}, "deflate", "Should use deflate if it is the only accepted encoding"},
+		{[]string{"", "gzip, deflate"}, "gzip", "Should use the Accept-Encoding header"},
+		{[]string{"", "gzip;q=0, deflate"}, "deflate", "Should ignore encodings with a quality of 0"},
+		{[]string{"", "gzip;q=0.0, deflate"}, "deflate", "Should parse the quality as a number"},
+		{[]string{"", "gzip; q=0.000, deflate;q=0.5"}, "deflate", "Should parse the quality as a number"},
+		{[]string{"br", ""}, "", "Should not use unsupported encodings"},
+		{[]string{"", ""}, "", "Should not compress if no encoding is accepted"},
+	}
+	for _, test := range tests {
+		if got := encoding(test.accepts...); got != test.want {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%s\nGot :%s", test.want, got)
+		}
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	t.Parallel()
+
+	b := bytes.Repeat([]byte("<message/>"), 20)
+
+	// Should not compress bodies at or below the threshold
+	rec := httptest.NewRecorder()
+	compressWriter{ResponseWriter: rec, encoding: "gzip", threshold: len(b)}.Write(b)
+	if !reflect.DeepEqual(rec.Body.Bytes(), b) || rec.Header().Get("Content-Encoding") != "" {
+		t.Error("Should not compress bodies at or below the threshold")
+	}
+
+	// Should not compress if the encoding is empty
+	rec = httptest.NewRecorder()
+	compressWriter{ResponseWriter: rec, threshold: 0}.Write(b)
+	if !reflect.DeepEqual(rec.Body.Bytes(), b) {
+		t.Error("Should not compress if the encoding is empty")
+	}
+
+	// Should compress bodies above the threshold with gzip
+	rec = httptest.NewRecorder()
+	n, err := compressWriter{ResponseWriter: rec, encoding: "gzip", threshold: 10}.Write(b)
+	if err != nil || n != len(b) {
+		t.Errorf("Should report the uncompressed length written. Got %d %v", n, err)
+	}
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("Should set the Content-Encoding header")
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got, _ := ioutil.ReadAll(zr)
+	if !reflect.DeepEqual(got, b) {
+		t.Error("Should compress bodies above the threshold with gzip")
+		t.Errorf("\nWant:%s\nGot :%s", b, got)
+	}
+
+	// Should compress bodies above the threshold with deflate
+	rec = httptest.NewRecorder()
+	compressWriter{ResponseWriter: rec, encoding: "deflate", threshold: 10}.Write(b)
+	zr2, err := zlib.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got, _ = ioutil.ReadAll(zr2)
+	if !reflect.DeepEqual(got, b) || rec.Header().Get("Content-Encoding") != "deflate" {
+		t.Error("Should compress bodies above the threshold with deflate")
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	t.Parallel()
+
+	b := []byte("<body rid='1' xmlns='http://jabber.org/protocol/httpbind'/>")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+
+	// Should decompress gzip request bodies
+	r := httptest.NewRequest("POST", "/", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	body, err := decompress(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got, _ := ioutil.ReadAll(body)
+	if !reflect.DeepEqual(got, b) {
+		t.Error("Should decompress gzip request bodies")
+		t.Errorf("\nWant:%s\nGot :%s", b, got)
+	}
+
+	// Should return uncompressed request bodies unchanged
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(b))
+	body, err = decompress(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got, _ = ioutil.ReadAll(body)
+	if !reflect.DeepEqual(got, b) {
+		t.Error("Should return uncompressed request bodies unchanged")
+	}
+
+	// Should return ErrUnsupportedEncoding for unknown encodings
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(b))
+	r.Header.Set("Content-Encoding", "br")
+	if _, err = decompress(r); err != ErrUnsupportedEncoding {
+		t.Error("Should return ErrUnsupportedEncoding for unknown encodings")
+		t.Errorf("\nWant:%s\nGot :%v", ErrUnsupportedEncoding, err)
+	}
+}
+
+func TestHandlerwriter(t *testing.T) {
+	t.Parallel()
+
+	// Should vary on Accept-Encoding whenever compression is enabled
+	h := NewHandler(nil, BodyTransformer{}, Body{}, "localhost")
+	rec := httptest.NewRecorder()
+	h.writer(rec, httptest.NewRequest("POST", "/", nil), &Session{}).Write([]byte("<body/>"))
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Error("Should vary on Accept-Encoding whenever compression is enabled")
+		t.Errorf("\nWant:%s\nGot :%s", "Accept-Encoding", got)
+	}
+
+	// Should not vary on Accept-Encoding if compression is disabled
+	h.Compress(-1)
+	rec = httptest.NewRecorder()
+	h.writer(rec, httptest.NewRequest("POST", "/", nil), &Session{}).Write([]byte("<body/>"))
+	if got := rec.Header().Get("Vary"); got != "" {
+		t.Error("Should not vary on Accept-Encoding if compression is disabled")
+		t.Errorf("\nGot :%s", got)
+	}
+}
+
+func TestHandlerServeHTTPBodyTooLarge(t *testing.T) {
+	t.Parallel()
+
+	h := NewHandler(nil, BodyTransformer{}, Body{}, "localhost").MaxBodySize(1024)
+
+	// Should reject bodies larger than the maximum size
+	body := "<body rid='1' xmlns='http://jabber.org/protocol/httpbind'>" +
+		strings.Repeat("<message/>", 200) + "</body>"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Should reject bodies larger than the maximum size")
+		t.Errorf("\nWant:%d\nGot :%d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+
+	// Should reject bodies that are larger than the maximum size once
+	// decompressed
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(body))
+	zw.Close()
+	if buf.Len() > 1024 {
+		t.Fatalf("Compressed body is too large: %d", buf.Len())
+	}
+	req := httptest.NewRequest("POST", "/", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Should reject bodies that are larger than the maximum size once decompressed")
+		t.Errorf("\nWant:%d\nGot :%d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
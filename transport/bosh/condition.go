@@ -0,0 +1,112 @@
+package bosh
+
+import (
+	"net/http"
+
+	"github.com/skriptble/nine/element"
+)
+
+// TerminateError is an error that ends a BOSH session with one of the terminal
+// binding conditions described in
+// http://xmpp.org/extensions/xep-0124.html#errorstatus-terminal
+type TerminateError struct {
+	Condition string
+	// Status is the HTTP status code sent to legacy clients, those that did
+	// not include a ver attribute when creating the session. Clients that
+	// support the terminal binding conditions always receive 200 OK.
+	Status int
+	// URI is the URI the client should connect to when the condition is
+	// see-other-uri.
+	URI string
+	// Children are the elements included in the terminate body, such as the
+	// stream error for a remote-stream-error.
+	Children []element.Element
+}
+
+func (e *TerminateError) Error() string {
+	return "bosh: " + e.Condition
+}
+
+// TransformElement returns the terminate body for this error.
+func (e *TerminateError) TransformElement() element.Element {
+	return Body{Type: "terminate", Condition: e.Condition, Children: e.payload()}.TransformElement()
+}
+
+// payload returns the elements included in the terminate body for this error.
+func (e *TerminateError) payload() []element.Element {
+	if e.URI == "" {
+		return e.Children
+	}
+	uri := element.New("uri")
+	uri.Child = []element.Token{element.CharData{Data: e.URI}}
+	return append(e.Children[:len(e.Children):len(e.Children)], uri)
+}
+
+var (
+	ErrBadRequest             = &TerminateError{Condition: "bad-request", Status: http.StatusBadRequest}
+	ErrHostGone               = &TerminateError{Condition: "host-gone", Status: http.StatusOK}
+	ErrHostUnknown            = &TerminateError{Condition: "host-unknown", Status: http.StatusOK}
+	ErrImproperAddressing     = &TerminateError{Condition: "improper-addressing", Status: http.StatusOK}
+	ErrInternalServerError    = &TerminateError{Condition: "internal-server-error", Status: http.StatusOK}
+	ErrItemNotFound           = &TerminateError{Condition: "item-not-found", Status: http.StatusNotFound}
+	ErrOtherRequest           = &TerminateError{Condition: "other-request", Status: http.StatusOK}
+	ErrPolicyViolation        = &TerminateError{Condition: "policy-violation", Status: http.StatusForbidden}
+	ErrRemoteConnectionFailed = &TerminateError{Condition: "remote-connection-failed", Status: http.StatusOK}
+	ErrSystemShutdown         = &TerminateError{Condition: "system-shutdown", Status: http.StatusOK}
+	ErrUndefinedCondition     = &TerminateError{Condition: "undefined-condition", Status: http.StatusOK}
+)
+
+// SeeOtherURI returns a see-other-uri error that redirects the client to the
+// given URI.
+func SeeOtherURI(uri string) *TerminateError {
+	return &TerminateError{Condition: "see-other-uri", Status: http.StatusOK, URI: uri}
+}
+
+// RemoteStreamError returns a remote-stream-error that includes the given
+// stream error elements in the terminate body.
+func RemoteStreamError(els ...element.Element) *TerminateError {
+	return &TerminateError{Condition: "remote-stream-error", Status: http.StatusOK, Children: els}
+}
+
+// conditions are the terminal binding conditions that have a matching error.
+var conditions = map[string]*TerminateError{
+	ErrBadRequest.Condition:             ErrBadRequest,
+	ErrHostGone.Condition:               ErrHostGone,
+	ErrHostUnknown.Condition:            ErrHostUnknown,
+	ErrImproperAddressing.Condition:     ErrImproperAddressing,
+	ErrInternalServerError.Condition:    ErrInternalServerError,
+	ErrItemNotFound.Condition:           ErrItemNotFound,
+	ErrOtherRequest.Condition:           ErrOtherRequest,
+	ErrPolicyViolation.Condition:        ErrPolicyViolation,
+	ErrRemoteConnectionFailed.Condition: ErrRemoteConnectionFailed,
+	ErrSystemShutdown.Condition:         ErrSystemShutdown,
+	ErrUndefinedCondition.Condition:     ErrUndefinedCondition,
+}
+
+// terminateError returns the error for the terminate body b received from a
+// connection manager. A terminate without a condition returns nil.
+func terminateError(b Body) *TerminateError {
+	switch b.Condition {
+	case "":
+		return nil
+	case "see-other-uri":
+		var uri string
+		for _, child := range b.Children {
+			if child.Tag != "uri" {
+				continue
+			}
+			for _, token := range child.Child {
+				if cd, ok := token.(element.CharData); ok {
+					uri += cd.Data
+				}
+			}
+		}
+		return SeeOtherURI(uri)
+	case "remote-stream-error":
+		return RemoteStreamError(b.Children...)
+	}
+	if err, ok := conditions[b.Condition]; ok {
+		return err
+	}
+	return &TerminateError{Condition: b.Condition, Status: http.StatusOK}
+}
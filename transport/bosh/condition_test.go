@@ -0,0 +1,62 @@
+package bosh
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
+)
+
+func TestTerminateErrorTransformElement(t *testing.T) {
+	t.Parallel()
+
+	var want, got element.Element
+	var uri element.Element
+
+	// Should add the type and condition attributes
+	want = body.
+		AddAttr("type", "terminate").
+		AddAttr("condition", "item-not-found")
+	got = ErrItemNotFound.TransformElement()
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should add the type and condition attributes")
+		t.Errorf("\nWant:%+v\nGot :%+v", want, got)
+	}
+
+	// Should add a uri child for see-other-uri
+	uri = element.New("uri")
+	uri.Child = []element.Token{element.CharData{Data: "https://example.com/bosh"}}
+	want = body.
+		AddAttr("type", "terminate").
+		AddAttr("condition", "see-other-uri").
+		AddChild(uri)
+	got = SeeOtherURI("https://example.com/bosh").TransformElement()
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should add a uri child for see-other-uri")
+		t.Errorf("\nWant:%+v\nGot :%+v", want, got)
+	}
+
+	// Should add the stream error for remote-stream-error
+	want = body.
+		AddAttr("type", "terminate").
+		AddAttr("condition", "remote-stream-error").
+		AddChild(element.New("stream:error")).
+		AddAttr("xmlns:stream", namespace.Stream)
+	got = RemoteStreamError(element.New("stream:error")).TransformElement()
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should add the stream error for remote-stream-error")
+		t.Errorf("\nWant:%+v\nGot :%+v", want, got)
+	}
+}
+
+func TestTerminateErrorError(t *testing.T) {
+	t.Parallel()
+
+	want := "bosh: policy-violation"
+	got := ErrPolicyViolation.Error()
+	if want != got {
+		t.Error("Should return the condition as the error")
+		t.Errorf("\nWant:%s\nGot :%s", want, got)
+	}
+}
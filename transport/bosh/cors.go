@@ -0,0 +1,74 @@
+package bosh
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultContentType is the Content-Type of responses for sessions whose
+// client did not request one with the content attribute.
+const defaultContentType = "text/xml; charset=utf-8"
+
+// defaultAllowedHeaders are the request headers browsers may send from another
+// origin if no headers have been set with AllowHeaders.
+var defaultAllowedHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// AllowOrigins sets the origins browsers may make cross-origin requests from,
+// as described by http://www.w3.org/TR/cors/. An origin of "*" allows every
+// origin. By default cross-origin requests are not allowed.
+func (h *Handler) AllowOrigins(origins ...string) *Handler {
+	h.origins = origins
+	return h
+}
+
+// AllowHeaders sets the request headers browsers may send with cross-origin
+// requests. By default the Content-Type and Content-Encoding headers are
+// allowed.
+func (h *Handler) AllowHeaders(headers ...string) *Handler {
+	h.headers = headers
+	return h
+}
+
+// MaxAge sets how long browsers may cache the result of a preflight request.
+// If it is 0 no Access-Control-Max-Age header is sent.
+func (h *Handler) MaxAge(age time.Duration) *Handler {
+	h.maxAge = age
+	return h
+}
+
+// allowed returns true if cross-origin requests from origin are allowed.
+func (h *Handler) allowed(origin string) bool {
+	for _, o := range h.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// cors writes the Access-Control headers for r to rw. Nothing is written if r
+// is not a cross-origin request from an allowed origin. If preflight is true
+// the headers for a preflight request are included.
+func (h *Handler) cors(rw http.ResponseWriter, r *http.Request, preflight bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !h.allowed(origin) {
+		return
+	}
+	header := rw.Header()
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Add("Vary", "Origin")
+	if !preflight {
+		return
+	}
+	headers := h.headers
+	if headers == nil {
+		headers = defaultAllowedHeaders
+	}
+	header.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if h.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(h.maxAge/time.Second)))
+	}
+}
@@ -0,0 +1,84 @@
+package bosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerServeHTTPPreflight(t *testing.T) {
+	t.Parallel()
+
+	h := NewHandler(nil, BodyTransformer{}, Body{}, "localhost").
+		AllowOrigins("https://example.com").
+		MaxAge(10 * time.Minute)
+
+	// Should answer preflight requests from allowed origins
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	h.ServeHTTP(rec, req)
+	var tests = []struct {
+		header, want string
+	}{
+		{"Access-Control-Allow-Origin", "https://example.com"},
+		{"Access-Control-Allow-Methods", "POST, OPTIONS"},
+		{"Access-Control-Allow-Headers", "Content-Type, Content-Encoding"},
+		{"Access-Control-Max-Age", "600"},
+	}
+	if rec.Code != http.StatusOK {
+		t.Error("Should answer preflight requests from allowed origins")
+		t.Errorf("\nWant:%d\nGot :%d", http.StatusOK, rec.Code)
+	}
+	for _, test := range tests {
+		if got := rec.Header().Get(test.header); got != test.want {
+			t.Errorf("Should set the %s header", test.header)
+			t.Errorf("\nWant:%s\nGot :%s", test.want, got)
+		}
+	}
+
+	// Should not allow other origins
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://example.org")
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Error("Should not allow other origins")
+		t.Errorf("\nGot :%s", got)
+	}
+}
+
+func TestHandlerServeHTTPCORS(t *testing.T) {
+	t.Parallel()
+
+	h := NewHandler(nil, BodyTransformer{}, Body{}, "localhost").AllowOrigins("*")
+
+	// Should allow any origin and set the Content-Type on responses
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='1' to='example.org' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`))
+	req.Header.Set("Origin", "https://example.com")
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Error("Should allow any origin")
+		t.Errorf("\nWant:%s\nGot :%s", "https://example.com", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Error("Should only send the preflight headers for preflight requests")
+	}
+	if got := rec.Header().Get("Content-Type"); got != defaultContentType {
+		t.Error("Should set the Content-Type on responses")
+		t.Errorf("\nWant:%s\nGot :%s", defaultContentType, got)
+	}
+
+	// Should reject other methods
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST, OPTIONS" {
+		t.Error("Should reject other methods")
+		t.Errorf("\nGot :%d %s", rec.Code, rec.Header().Get("Allow"))
+	}
+}
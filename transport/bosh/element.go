@@ -6,5 +6,13 @@ import (
 )
 
 var body = element.New("body").AddAttr("xmlns", namespace.BOSH)
-var BadRequest = body.AddAttr("type", "terminate").AddAttr("condition", "bad-request")
-var PolicyViolation = body.AddAttr("type", "terminate").AddAttr("condition", "policy-violation")
+
+// BadRequest is the terminate body of a bad-request error.
+//
+// Deprecated: Use ErrBadRequest.
+var BadRequest = ErrBadRequest.TransformElement()
+
+// PolicyViolation is the terminate body of a policy-violation error.
+//
+// Deprecated: Use ErrPolicyViolation.
+var PolicyViolation = ErrPolicyViolation.TransformElement()
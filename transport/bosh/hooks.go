@@ -0,0 +1,65 @@
+package bosh
+
+// Hooks observes the lifecycle of the sessions created by a Handler. The
+// methods are called synchronously from the goroutine handling the event, so
+// implementations must be safe for concurrent use and should return quickly.
+// They must not call methods of the session that block on its processing,
+// such as Process or Terminate.
+type Hooks interface {
+	// OnSessionCreated is called once a session has been created, before its
+	// creation request is processed.
+	OnSessionCreated(s *Session)
+	// OnRequest is called for each request accepted by the session,
+	// including the session creation request. Repeated requests are not
+	// included.
+	OnRequest(s *Session, b Body)
+	// OnResponse is called with each response before it is written to the
+	// client.
+	OnResponse(s *Session, b Body)
+	// OnRestart is called when the client restarts a stream. The stream is
+	// empty for the session's first stream.
+	OnRestart(s *Session, stream string)
+	// OnExpired is called when a session is closed because the client has
+	// been inactive for longer than the inactivity period.
+	OnExpired(s *Session)
+	// OnTerminated is called when the session is terminated by the client,
+	// or by the server with the given terminal binding condition. A client
+	// terminate has the condition the client sent, which is usually empty.
+	OnTerminated(s *Session, condition string)
+}
+
+// NopHooks is a Hooks that does nothing. It can be embedded to implement only
+// some of the methods of Hooks.
+type NopHooks struct{}
+
+func (NopHooks) OnSessionCreated(*Session)     {}
+func (NopHooks) OnRequest(*Session, Body)      {}
+func (NopHooks) OnResponse(*Session, Body)     {}
+func (NopHooks) OnRestart(*Session, string)    {}
+func (NopHooks) OnExpired(*Session)            {}
+func (NopHooks) OnTerminated(*Session, string) {}
+
+// Hooks sets the hooks that observe the sessions created by the handler.
+func (h *Handler) Hooks(hooks Hooks) *Handler {
+	h.hooks = hooks
+	return h
+}
+
+// SetHooks sets the hooks that observe the session. Sessions created by a
+// Handler use the hooks of the Handler.
+func (s *Session) SetHooks(hooks Hooks) {
+	s.lock.Lock()
+	s.hooks = hooks
+	s.lock.Unlock()
+}
+
+// observer returns the hooks of the session, or NopHooks if none have been
+// set.
+func (s *Session) observer() Hooks {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.hooks == nil {
+		return NopHooks{}
+	}
+	return s.hooks
+}
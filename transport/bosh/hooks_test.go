@@ -0,0 +1,147 @@
+package bosh
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+)
+
+// recordHooks is a Hooks that records the events it observes.
+type recordHooks struct {
+	events []string
+	sync.Mutex
+}
+
+func (h *recordHooks) record(event string) {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *recordHooks) OnSessionCreated(s *Session) { h.record("created") }
+func (h *recordHooks) OnRequest(s *Session, b Body) {
+	h.record(fmt.Sprintf("request %d", b.RID))
+}
+func (h *recordHooks) OnResponse(s *Session, b Body) { h.record("response " + b.Type) }
+func (h *recordHooks) OnRestart(s *Session, stream string) {
+	h.record("restart " + stream)
+}
+func (h *recordHooks) OnExpired(s *Session) { h.record("expired") }
+func (h *recordHooks) OnTerminated(s *Session, condition string) {
+	h.record("terminated " + condition)
+}
+
+// wait returns the recorded events once there are n of them.
+func (h *recordHooks) wait(t *testing.T, n int) []string {
+	t.Helper()
+	transporttest.Eventually(t, func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return len(h.events) >= n
+	})
+	h.Lock()
+	defer h.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+func TestHandlerHooks(t *testing.T) {
+	t.Parallel()
+
+	reg := new(mapRegister)
+	hooks := new(recordHooks)
+	h := NewHandler(reg, BodyTransformer{}, Body{}, "localhost").Hooks(hooks)
+
+	// Should observe the creation of a session
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='1' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	want := []string{"created", "request 1", "response "}
+	got := hooks.wait(t, len(want))
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should observe the creation of a session")
+		t.Errorf("\nWant:%s\nGot :%s", want, got)
+	}
+
+	// Should observe the client terminating the session
+	var sid string
+	reg.Lock()
+	for id := range reg.sessions {
+		sid = id
+	}
+	reg.Unlock()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(
+		`<body rid='2' sid='`+sid+`' type='terminate' xmlns='http://jabber.org/protocol/httpbind'/>`)))
+	got = hooks.wait(t, len(want)+3)
+	observed := make(map[string]bool)
+	for _, event := range got[len(want):] {
+		observed[strings.TrimSuffix(event, "terminate")] = true
+	}
+	for _, event := range []string{"request 2", "terminated ", "response "} {
+		if !observed[event] {
+			t.Error("Should observe the client terminating the session")
+			t.Errorf("\nWant:%s\nGot :%s", event, got)
+		}
+	}
+}
+
+func TestSessionHooks(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var hooks *recordHooks
+	var want, got []string
+
+	// Should observe a server terminating the session once
+	s = NewSessionFromResponse(1, Body{SID: "foobar", Wait: time.Second, Inactivity: 10 * time.Second})
+	hooks = new(recordHooks)
+	s.SetHooks(hooks)
+	s.Terminate(ErrPolicyViolation)
+	s.Terminate(ErrSystemShutdown)
+	want = []string{"terminated policy-violation"}
+	got = hooks.wait(t, len(want))
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should observe a server terminating the session once")
+		t.Errorf("\nWant:%s\nGot :%s", want, got)
+	}
+
+	// Should observe a session expiring
+	s = &Session{inactivity: time.Millisecond, exit: make(chan struct{})}
+	hooks = new(recordHooks)
+	s.SetHooks(hooks)
+	s.lock.Lock()
+	s.idle(time.Now())
+	s.lock.Unlock()
+	want = []string{"expired"}
+	got = hooks.wait(t, len(want))
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should observe a session expiring")
+		t.Errorf("\nWant:%s\nGot :%s", want, got)
+	}
+
+	// Should observe a restart of the session's first stream
+	s = NewSessionFromResponse(2, Body{SID: "foobar", Hold: 1, Requests: 2, Wait: time.Second,
+		Inactivity: 10 * time.Second})
+	hooks = new(recordHooks)
+	s.SetHooks(hooks)
+	s.lock.Lock()
+	s.restartable = true
+	s.lock.Unlock()
+	r := NewRequest(2, time.Second, "foobar", Body{RID: 2, Restart: true}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want = []string{"request 2", "restart "}
+	got = hooks.wait(t, len(want))
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Should observe a restart of the session's first stream")
+		t.Errorf("\nWant:%s\nGot :%s", want, got)
+	}
+	s.Close()
+}
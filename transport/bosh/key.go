@@ -0,0 +1,34 @@
+package bosh
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// maxKeyDistance is the largest number of RIDs a request's key may be from the
+// last verified key. This bounds the amount of hashing a request can cause.
+const maxKeyDistance = 16
+
+// hashKey returns the key hashed n times. Each hash is the hex encoded SHA-1
+// of the previous key as described in
+// http://xmpp.org/extensions/xep-0124.html#keys
+func hashKey(key string, n int) string {
+	for i := 0; i < n; i++ {
+		sum := sha1.Sum([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// verifyKey verifies that key is the key for rid in the sequence that has key
+// last for lastRID. The keys are used in reverse order of generation, so the
+// hash of a later request's key is the key of the request before it.
+func verifyKey(key string, rid int, last string, lastRID int) bool {
+	switch {
+	case rid > lastRID && rid-lastRID <= maxKeyDistance:
+		return hashKey(key, rid-lastRID) == last
+	case rid < lastRID && lastRID-rid <= maxKeyDistance:
+		return hashKey(last, lastRID-rid) == key
+	}
+	return false
+}
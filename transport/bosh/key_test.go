@@ -0,0 +1,57 @@
+package bosh
+
+import "testing"
+
+func TestHashKey(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		key  string
+		n    int
+		want string
+		msg  string
+	}{
+		{key: "foo", n: 0, want: "foo", msg: "Should return the key when hashed 0 times"},
+		{key: "foo", n: 1, want: "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", msg: "Should return the hex SHA-1 of the key"},
+		{key: "foo", n: 2, want: "2865765152809a426f118f48c468c5f459425211", msg: "Should hash the key n times"},
+	}
+	for _, test := range tests {
+		got := hashKey(test.key, test.n)
+		if got != test.want {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%s\nGot :%s", test.want, got)
+		}
+	}
+}
+
+func TestVerifyKey(t *testing.T) {
+	t.Parallel()
+
+	// K(3) is sent at session creation, K(2), K(1), K(0) with the following
+	// requests.
+	var k0 = "seed"
+	var k1, k2, k3 = hashKey(k0, 1), hashKey(k0, 2), hashKey(k0, 3)
+	var tests = []struct {
+		key     string
+		rid     int
+		last    string
+		lastRID int
+		want    bool
+		msg     string
+	}{
+		{key: k2, rid: 11, last: k3, lastRID: 10, want: true, msg: "Should verify the next key"},
+		{key: k1, rid: 12, last: k3, lastRID: 10, want: true, msg: "Should verify a key that arrived out of order"},
+		{key: k2, rid: 11, last: k1, lastRID: 12, want: true, msg: "Should verify a key that arrived late"},
+		{key: k1, rid: 11, last: k3, lastRID: 10, want: false, msg: "Should not verify a key for the wrong RID"},
+		{key: "bar", rid: 11, last: k3, lastRID: 10, want: false, msg: "Should not verify an incorrect key"},
+		{key: k3, rid: 10, last: k3, lastRID: 10, want: false, msg: "Should not verify a reused key"},
+		{key: k2, rid: 10 + maxKeyDistance + 1, last: k3, lastRID: 10, want: false, msg: "Should not verify a key too far from the last key"},
+	}
+	for _, test := range tests {
+		got := verifyKey(test.key, test.rid, test.last, test.lastRID)
+		if got != test.want {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%t\nGot :%t", test.want, got)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package bosh
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/nine/stream"
+)
+
+// A MemoryRegister is a StreamRegister and SweepingRegister that keeps its
+// sessions in memory. The streams of each session are run by a stream factory,
+// and a janitor goroutine periodically closes and removes the sessions that
+// have expired or been closed, so sessions that are never looked up again do
+// not stay in the register forever.
+type MemoryRegister struct {
+	factory  transport.StreamFactory
+	sessions map[string]*Session
+	removed  func(sid string)
+	exit     chan struct{}
+	sync.RWMutex
+}
+
+// NewMemoryRegister creates a MemoryRegister that runs the streams of its
+// sessions with factory and sweeps the expired sessions every interval. If
+// factory is nil no streams are run. If interval is not positive sessions are
+// only removed when they are looked up after they have expired.
+func NewMemoryRegister(factory transport.StreamFactory, interval time.Duration) *MemoryRegister {
+	r := new(MemoryRegister)
+	r.factory = factory
+	r.sessions = make(map[string]*Session)
+	r.exit = make(chan struct{})
+	if interval > 0 {
+		go r.janitor(interval)
+	}
+	return r
+}
+
+// Add adds a session to the register and runs its first stream.
+func (r *MemoryRegister) Add(sid string, s *Session) {
+	r.Lock()
+	r.sessions[sid] = s
+	r.Unlock()
+	if r.factory != nil {
+		r.factory(NewTransport(stream.Receiving, s), s.Domain())
+	}
+}
+
+// AddStream runs a stream added to the session with the given sid.
+func (r *MemoryRegister) AddStream(sid string, st *Stream) {
+	if r.factory != nil {
+		r.factory(NewStreamTransport(stream.Receiving, st), st.To())
+	}
+}
+
+// Remove removes a session from the register.
+func (r *MemoryRegister) Remove(sid string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.sessions, sid)
+}
+
+// Lookup returns the Session associated with the given sid. If the session
+// doesn't exist or has expired, ErrSessionNotFound is returned.
+func (r *MemoryRegister) Lookup(sid string) (*Session, error) {
+	r.RLock()
+	s, ok := r.sessions[sid]
+	r.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if s.Expired() {
+		r.drop(sid)
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// OnRemove sets the function called with the sid of each session the register
+// removes because it has expired or been closed. It is not called for sessions
+// removed with Remove.
+func (r *MemoryRegister) OnRemove(fn func(sid string)) {
+	r.Lock()
+	defer r.Unlock()
+	r.removed = fn
+}
+
+// drop removes the session with the given sid from the register and calls the
+// OnRemove function.
+func (r *MemoryRegister) drop(sid string) {
+	r.Lock()
+	delete(r.sessions, sid)
+	fn := r.removed
+	r.Unlock()
+	if fn != nil {
+		fn(sid)
+	}
+}
+
+// Len returns the number of sessions in the register.
+func (r *MemoryRegister) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.sessions)
+}
+
+// Range calls fn for each session in the register until fn returns false.
+// The sessions are those in the register when Range is called, fn may add or
+// remove sessions.
+func (r *MemoryRegister) Range(fn func(sid string, s *Session) bool) {
+	r.RLock()
+	sessions := make(map[string]*Session, len(r.sessions))
+	for sid, s := range r.sessions {
+		sessions[sid] = s
+	}
+	r.RUnlock()
+	for sid, s := range sessions {
+		if !fn(sid, s) {
+			return
+		}
+	}
+}
+
+// Close stops the janitor goroutine. The sessions in the register are not
+// closed.
+func (r *MemoryRegister) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.exit:
+	default:
+		close(r.exit)
+	}
+	return nil
+}
+
+// janitor sweeps the register every interval until the register is closed.
+func (r *MemoryRegister) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.exit:
+			return
+		case <-ticker.C:
+			r.sweep()
+		}
+	}
+}
+
+// sweep expires the sessions whose inactivity period has passed and removes
+// them, along with any session that has already been closed.
+func (r *MemoryRegister) sweep() {
+	r.Range(func(sid string, s *Session) bool {
+		if !s.Expired() {
+			s.expire()
+		}
+		select {
+		case <-s.exit:
+		default:
+			return true
+		}
+		log.Println("Removing closed session ", sid)
+		r.drop(sid)
+		return true
+	})
+}
@@ -0,0 +1,128 @@
+package bosh
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/stream"
+)
+
+func TestMemoryRegister(t *testing.T) {
+	t.Parallel()
+
+	var domains []string
+	factory := func(tp stream.Transport, domain string) {
+		domains = append(domains, domain)
+	}
+	r := NewMemoryRegister(factory, 0)
+	defer r.Close()
+	s := NewSessionFromResponse(1, Body{SID: "foobar", To: "example.com", Wait: time.Second,
+		Inactivity: 10 * time.Second})
+	defer s.Close()
+
+	// Should run the stream of added sessions
+	r.Add("foobar", s)
+	r.AddStream("foobar", s.AddStream("example.org"))
+	want := []string{"example.com", "example.org"}
+	if !reflect.DeepEqual(want, domains) {
+		t.Error("Should run the stream of added sessions")
+		t.Errorf("\nWant:%s\nGot :%s", want, domains)
+	}
+
+	// Should lookup added sessions
+	got, err := r.Lookup("foobar")
+	if err != nil || got != s {
+		t.Error("Should lookup added sessions")
+		t.Errorf("\nGot :%v %s", got, err)
+	}
+
+	// Should range over the sessions
+	r.Add("bazqux", &Session{exit: make(chan struct{})})
+	if r.Len() != 2 {
+		t.Error("Should count the sessions")
+		t.Errorf("\nWant:%d\nGot :%d", 2, r.Len())
+	}
+	var sids []string
+	r.Range(func(sid string, s *Session) bool {
+		sids = append(sids, sid)
+		return true
+	})
+	sort.Strings(sids)
+	if !reflect.DeepEqual([]string{"bazqux", "foobar"}, sids) {
+		t.Error("Should range over the sessions")
+		t.Errorf("\nGot :%s", sids)
+	}
+	var count int
+	r.Range(func(sid string, s *Session) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Error("Should stop ranging when fn returns false")
+	}
+
+	// Should not lookup removed or expired sessions
+	r.Remove("foobar")
+	if _, err := r.Lookup("foobar"); err != ErrSessionNotFound {
+		t.Error("Should not lookup removed sessions")
+	}
+	r.Add("expired", &Session{expired: true})
+	if _, err := r.Lookup("expired"); err != ErrSessionNotFound {
+		t.Error("Should not lookup expired sessions")
+	}
+	if r.Len() != 1 {
+		t.Error("Should remove expired sessions when they are looked up")
+	}
+}
+
+func TestMemoryRegistersweep(t *testing.T) {
+	t.Parallel()
+
+	r := NewMemoryRegister(nil, 0)
+	defer r.Close()
+	live := &Session{exit: make(chan struct{}), expiry: time.Now().Add(time.Hour)}
+	inactive := &Session{exit: make(chan struct{}), expiry: time.Now().Add(-time.Second)}
+	closed := &Session{exit: make(chan struct{})}
+	closed.Close()
+	r.Add("live", live)
+	r.Add("inactive", inactive)
+	r.Add("closed", closed)
+
+	r.sweep()
+
+	// Should close and remove sessions whose inactivity period has passed
+	if !inactive.Expired() {
+		t.Error("Should expire sessions whose inactivity period has passed")
+	}
+	select {
+	case <-inactive.exit:
+	default:
+		t.Error("Should close sessions whose inactivity period has passed")
+	}
+	if _, ok := r.sessions["inactive"]; ok {
+		t.Error("Should remove sessions whose inactivity period has passed")
+	}
+
+	// Should remove closed sessions
+	if _, ok := r.sessions["closed"]; ok {
+		t.Error("Should remove closed sessions")
+	}
+
+	// Should keep active sessions
+	if _, ok := r.sessions["live"]; !ok || live.Expired() {
+		t.Error("Should keep active sessions")
+	}
+}
+
+func TestMemoryRegisterjanitor(t *testing.T) {
+	t.Parallel()
+
+	// Should periodically remove expired sessions
+	r := NewMemoryRegister(nil, time.Millisecond)
+	defer r.Close()
+	r.Add("foobar", &Session{exit: make(chan struct{}), expiry: time.Now().Add(-time.Second)})
+	transporttest.Eventually(t, func() bool { return r.Len() == 0 })
+}
@@ -0,0 +1,257 @@
+package bosh
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/xmpp"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
+	"github.com/skriptble/nine/stream"
+)
+
+// A Proxy is a Register that connects each session to an upstream XMPP server
+// over TCP. This allows the Handler to be used as a connection manager in
+// front of an existing XMPP server, as described in
+// http://xmpp.org/extensions/xep-0206.html
+//
+// The upstream server is the Proxy's default upstream. A client may request
+// another upstream with a route when creating the session, but only routes to
+// the default upstream or approved by AllowRoutes are dialed. Sessions whose
+// upstream cannot be reached are terminated with remote-connection-failed and
+// stream errors sent by the upstream server terminate the session with
+// remote-stream-error.
+//
+// The connection to the upstream server is not encrypted, the Proxy should
+// only be used with servers on a trusted network.
+type Proxy struct {
+	upstream string
+	allow    func(address string) bool
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	timeout  time.Duration
+
+	sessions map[string]*Session
+	sync.RWMutex
+}
+
+// NewProxy creates a Proxy that connects sessions to the given upstream
+// address when the client does not request a route. If upstream is empty the
+// session's domain is dialed on the default XMPP client port.
+func NewProxy(upstream string) *Proxy {
+	p := new(Proxy)
+	p.upstream = upstream
+	p.dial = new(net.Dialer).DialContext
+	p.timeout = defaultDialTimeout
+	p.sessions = make(map[string]*Session)
+	return p
+}
+
+// AllowRoutes sets the function used to decide if the upstream address from a
+// route requested by a client may be dialed. Sessions that request any other
+// route are terminated with host-unknown. By default only a route to the
+// default upstream is allowed.
+func (p *Proxy) AllowRoutes(fn func(address string) bool) *Proxy {
+	p.allow = fn
+	return p
+}
+
+// Dialer sets the function used to connect to upstream servers. The context
+// passed to fn is done once the dial timeout has passed.
+func (p *Proxy) Dialer(fn func(ctx context.Context, network, address string) (net.Conn, error)) *Proxy {
+	p.dial = fn
+	return p
+}
+
+// DialTimeout sets how long the Proxy waits for a connection to an upstream
+// server. Since the session creation request is answered once the connection
+// is made, the timeout should be shorter than the wait of the request.
+func (p *Proxy) DialTimeout(d time.Duration) *Proxy {
+	p.timeout = d
+	return p
+}
+
+// defaultDialTimeout is how long the Proxy waits for a connection to an
+// upstream server unless another timeout is set.
+const defaultDialTimeout = 10 * time.Second
+
+// Add connects the session to its upstream server and adds it to the Proxy.
+// If the upstream server cannot be reached within the dial timeout the
+// session is terminated. The session is removed from the Proxy once it is
+// closed or its upstream connection fails.
+func (p *Proxy) Add(sid string, s *Session) {
+	address, terr := p.address(s)
+	if terr != nil {
+		log.Println("Could not route session: ", terr)
+		s.Terminate(terr)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	conn, err := p.dial(ctx, "tcp", address)
+	cancel()
+	if err != nil {
+		log.Println("Could not connect to upstream: ", err)
+		s.Terminate(ErrRemoteConnectionFailed)
+		return
+	}
+	p.Lock()
+	p.sessions[sid] = s
+	p.Unlock()
+	go p.read(s, conn)
+	go p.write(sid, s, conn)
+}
+
+// Remove removes a session from the Proxy.
+func (p *Proxy) Remove(sid string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.sessions, sid)
+}
+
+// Lookup returns the Session associated with the given sid. If the session
+// doesn't exist, ErrSessionNotFound is returned.
+func (p *Proxy) Lookup(sid string) (s *Session, err error) {
+	p.RLock()
+	s, ok := p.sessions[sid]
+	p.RUnlock()
+	if !ok {
+		err = ErrSessionNotFound
+		return
+	}
+	if s.Expired() {
+		p.Remove(sid)
+		err = ErrSessionNotFound
+		s = nil
+	}
+	return
+}
+
+// address returns the address of the upstream server for the session. Routes
+// are of the form xmpp:host:port, any other protocol is improper addressing.
+// A route to any address other than the default upstream must be allowed by
+// the allow function, otherwise the session could be used to connect to any
+// host reachable from the Proxy.
+func (p *Proxy) address(s *Session) (string, *TerminateError) {
+	route := s.Route()
+	if route == "" {
+		if p.upstream != "" {
+			return p.upstream, nil
+		}
+		return net.JoinHostPort(s.Domain(), "5222"), nil
+	}
+	if !strings.HasPrefix(route, "xmpp:") {
+		return "", ErrImproperAddressing
+	}
+	address := strings.TrimPrefix(route, "xmpp:")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", ErrImproperAddressing
+	}
+	if address == p.upstream || (p.allow != nil && p.allow(address)) {
+		return address, nil
+	}
+	return "", ErrHostUnknown
+}
+
+// write opens a stream to the upstream server and writes the elements the
+// client sends to it. A new stream is opened each time the client restarts the
+// stream. The connection is closed and the session removed once the session is
+// closed.
+func (p *Proxy) write(sid string, s *Session, conn net.Conn) {
+	defer p.Remove(sid)
+	defer conn.Close()
+	if err := openStream(conn, s.Domain()); err != nil {
+		log.Println("Could not open upstream stream: ", err)
+		s.Terminate(ErrRemoteConnectionFailed)
+		return
+	}
+	for {
+		el, err := s.Element()
+		switch err {
+		case nil:
+			_, err = conn.Write(el.WriteBytes())
+		case stream.ErrRequireRestart:
+			err = openStream(conn, s.Domain())
+		default:
+			conn.Write([]byte("</stream:stream>"))
+			return
+		}
+		if err != nil {
+			log.Println("Could not write to upstream: ", err)
+			s.Terminate(ErrRemoteConnectionFailed)
+			return
+		}
+	}
+}
+
+// read writes the elements received from the upstream server to the session.
+// The stream headers sent by the upstream server are discarded, the client
+// only receives the elements within the streams.
+func (p *Proxy) read(s *Session, conn io.Reader) {
+	dec := xml.NewDecoder(conn)
+	for {
+		token, err := dec.RawToken()
+		if err != nil {
+			log.Println("Could not read from upstream: ", err)
+			s.Terminate(ErrRemoteConnectionFailed)
+			return
+		}
+		switch elem := token.(type) {
+		case xml.StartElement:
+			if elem.Name.Space == "stream" && elem.Name.Local == "stream" {
+				continue
+			}
+			el, err := xmpp.DecodeElement(elem, dec)
+			if err != nil {
+				log.Println("Could not read from upstream: ", err)
+				s.Terminate(ErrRemoteConnectionFailed)
+				return
+			}
+			if el.Space == "stream" && el.Tag == "error" {
+				s.Terminate(RemoteStreamError(el))
+				return
+			}
+			if el.Space == "stream" && el.Tag == "features" {
+				el = stripTLS(el)
+			}
+			if err := s.Write(el); err != nil {
+				return
+			}
+		case xml.EndElement:
+			log.Println("Upstream closed the stream")
+			s.Terminate(ErrRemoteConnectionFailed)
+			return
+		}
+	}
+}
+
+// openStream writes the opening stream header for domain to w.
+func openStream(w io.Writer, domain string) error {
+	var to bytes.Buffer
+	xml.EscapeText(&to, []byte(domain))
+	_, err := fmt.Fprintf(w,
+		"<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>",
+		to.String(), namespace.Client, namespace.Stream,
+	)
+	return err
+}
+
+// stripTLS removes the starttls feature from features. Clients cannot
+// negotiate TLS with the upstream server through a BOSH session.
+func stripTLS(features element.Element) element.Element {
+	var children []element.Token
+	for _, child := range features.Child {
+		if el, ok := child.(element.Element); ok && el.Tag == "starttls" {
+			continue
+		}
+		children = append(children, child)
+	}
+	features.Child = children
+	return features
+}
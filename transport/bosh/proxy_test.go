@@ -0,0 +1,205 @@
+package bosh
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/element"
+)
+
+func TestProxyaddress(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		p       *Proxy
+		route   string
+		address string
+		err     error
+		msg     string
+	}{
+		{
+			p: NewProxy("upstream:5222"), route: "",
+			address: "upstream:5222", msg: "Should use the default upstream",
+		},
+		{
+			p: NewProxy(""), route: "",
+			address: "example.com:5222", msg: "Should use the session's domain if there is no default",
+		},
+		{
+			p: NewProxy("upstream:5222"), route: "xmpp:upstream:5222",
+			address: "upstream:5222", msg: "Should allow a route to the default upstream",
+		},
+		{
+			p: NewProxy("upstream:5222"), route: "xmpp:other:5269",
+			err: ErrHostUnknown, msg: "Should not route to other addresses by default",
+		},
+		{
+			p:     NewProxy("upstream:5222").AllowRoutes(func(address string) bool { return address == "other:5269" }),
+			route: "xmpp:other:5269", address: "other:5269",
+			msg: "Should use the requested route if it is allowed",
+		},
+		{
+			p: NewProxy(""), route: "http:other:80",
+			err: ErrImproperAddressing, msg: "Should not route other protocols",
+		},
+		{
+			p: NewProxy(""), route: "xmpp:other",
+			err: ErrImproperAddressing, msg: "Should require a port in the route",
+		},
+		{
+			p:     NewProxy("").AllowRoutes(func(address string) bool { return address == "other:5222" }),
+			route: "xmpp:another:5222", err: ErrHostUnknown,
+			msg: "Should not route to addresses that are not allowed",
+		},
+	}
+	for _, test := range tests {
+		s := &Session{domain: "example.com", route: test.route}
+		address, err := test.p.address(s)
+		if address != test.address || (err == nil) != (test.err == nil) ||
+			(err != nil && err != test.err) {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%s %v\nGot :%s %v", test.address, test.err, address, err)
+		}
+	}
+}
+
+func TestProxyAddFailure(t *testing.T) {
+	t.Parallel()
+
+	// Should terminate the session with remote-connection-failed if the
+	// upstream cannot be reached
+	p := NewProxy("upstream:5222").Dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	})
+	s := NewSessionFromResponse(1, Body{SID: "foobar", To: "example.com", Wait: time.Second, Inactivity: 10 * time.Second})
+	p.Add("foobar", s)
+	r := NewRequest(1, time.Second, "foobar", Body{RID: 1}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != ErrRemoteConnectionFailed {
+		t.Error("Should terminate the session with remote-connection-failed")
+		t.Errorf("\nWant:%s\nGot :%v", ErrRemoteConnectionFailed, err)
+	}
+	if _, err := p.Lookup("foobar"); err != ErrSessionNotFound {
+		t.Error("Should not add a session that could not be connected")
+	}
+}
+
+func TestProxyDialTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Should stop dialing the upstream once the dial timeout has passed
+	p := NewProxy("upstream:5222").DialTimeout(time.Millisecond).Dialer(
+		func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	s := NewSessionFromResponse(1, Body{SID: "foobar", To: "example.com", Wait: time.Second, Inactivity: 10 * time.Second})
+	done := make(chan struct{})
+	go func() {
+		p.Add("foobar", s)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Should stop dialing the upstream once the dial timeout has passed")
+	}
+	r := NewRequest(1, time.Second, "foobar", Body{RID: 1}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != ErrRemoteConnectionFailed {
+		t.Error("Should terminate the session if the upstream could not be reached in time")
+		t.Errorf("\nWant:%s\nGot :%v", ErrRemoteConnectionFailed, err)
+	}
+}
+
+func TestProxyAdd(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	p := NewProxy("upstream:5222").Dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return client, nil
+	})
+	s := NewSessionFromResponse(1, Body{SID: "foobar", To: "example.com", Hold: 1, HoldSet: true,
+		Requests: 2, Wait: 2 * time.Second, Inactivity: 10 * time.Second})
+	defer s.Close()
+	p.Add("foobar", s)
+
+	// Should open a stream to the upstream server for the session's domain
+	dec := xml.NewDecoder(server)
+	header := func() (start xml.StartElement) {
+		for {
+			token, err := dec.RawToken()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if start, ok := token.(xml.StartElement); ok {
+				return start
+			}
+		}
+	}()
+	if header.Name.Local != "stream" || attrValue(header, "to") != "example.com" {
+		t.Error("Should open a stream to the upstream server for the session's domain")
+		t.Errorf("\nGot :%+v", header)
+	}
+
+	// Should write the upstream's elements to the session without starttls
+	r := NewRequest(1, 2*time.Second, "foobar", Body{RID: 1}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go io.WriteString(server, "<stream:stream from='example.com' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>"+
+		"<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/><bind/></stream:features>")
+	select {
+	case <-r.proceed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should write the upstream's elements to the session")
+	}
+	want := element.New("stream:features").AddChild(element.New("bind")).WriteBytes()
+	if len(r.payload) != 1 || !reflect.DeepEqual(r.payload[0].WriteBytes(), want) {
+		t.Error("Should write the upstream's elements to the session without starttls")
+		t.Errorf("\nWant:%s\nGot :%+v", want, r.payload)
+	}
+
+	// Should terminate the session with remote-stream-error on a stream error
+	r = NewRequest(2, 2*time.Second, "foobar", Body{RID: 2}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	transporttest.Eventually(t, func() bool { return len(s.queue) != 0 })
+	go io.WriteString(server, "<stream:error><host-gone/></stream:error>")
+	select {
+	case <-r.proceed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should answer held requests on a stream error")
+	}
+	if r.response.Type != "terminate" || r.response.Condition != "remote-stream-error" ||
+		len(r.payload) != 1 || r.payload[0].Tag != "error" {
+		t.Error("Should terminate the session with remote-stream-error on a stream error")
+		t.Errorf("\nGot :%+v %+v", r.response, r.payload)
+	}
+
+	// Should remove the session once it has ended
+	go io.Copy(io.Discard, server)
+	transporttest.Eventually(t, func() bool {
+		p.RLock()
+		defer p.RUnlock()
+		_, ok := p.sessions["foobar"]
+		return !ok
+	})
+}
+
+func attrValue(start xml.StartElement, key string) string {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == key {
+			return attr.Value
+		}
+	}
+	return ""
+}
@@ -1,14 +1,9 @@
 package bosh
 
-import "errors"
-
-// TODO: Register should be changed into an interface. This interface will be
-// responsible for creating the stream from the added sessions and closing the
-// stream from the removed sessions. This allows a very clean separation
-// between the BOSH layer and the stream. It also allows the BOSH Stream
-// transport to be potentially used for clients, although the current request
-// implementation is heavily geared toward the receiver. It would not take too
-// much effort to add the functionality for initating.
+import (
+	"errors"
+	"net/http"
+)
 
 // ErrSessionNotFound is the error returned when Lookup is called with a sid
 // that does not have a corresponding session in the Register.
@@ -20,10 +15,45 @@ var ErrSessionNotFound = errors.New("session not found")
 // for more sophisticated stream creation strategies, such as opening a
 // connection to an XMPP server. This package provides a stream transport
 // designed to work with a Session.
+//
+// The XMPP domain the client requested is available from the Session's Domain
+// method, so a single Register can serve several domains.
 type Register interface {
 	Add(sid string, s *Session)
 	Remove(sid string)
 	// Lookup finds a session by its session ID. Lookup should not return any
-	// session which has expired.
+	// session which has expired. A session's Expiry reports when it will
+	// expire if the client makes no further requests.
 	Lookup(sid string) (*Session, error)
 }
+
+// A StreamRegister is a Register that supports multiple streams within a
+// session. The Handler only offers multiple streams to clients if its Register
+// is a StreamRegister.
+//
+// AddStream is called when the client adds a stream to the session with the
+// given sid. The register handles the stream the same way it handles the first
+// stream of a session added with Add.
+type StreamRegister interface {
+	Register
+	AddStream(sid string, st *Stream)
+}
+
+// A SweepingRegister is a Register that removes sessions itself once they have
+// expired or been closed. OnRemove sets the function called with the sid of
+// each session removed this way, so a Register wrapping it can clean up after
+// the session as it would when its Remove method is called.
+type SweepingRegister interface {
+	Register
+	OnRemove(fn func(sid string))
+}
+
+// A ForwardRegister is a Register whose sessions may be owned by other nodes.
+// When Lookup returns an *OwnerError the Handler calls Forward to send the
+// request, whose decompressed body is body, to the owning node. If Forward
+// returns ErrForwardingDisabled the client is sent to the owning node with a
+// see-other-uri condition instead.
+type ForwardRegister interface {
+	Register
+	Forward(rw http.ResponseWriter, r *http.Request, body []byte, owner string) error
+}
@@ -1,8 +1,9 @@
 package bosh
 
 import (
+	"context"
 	"errors"
-	"io"
+	"net/http"
 	"sync"
 	"time"
 
@@ -29,6 +30,18 @@ type Request struct {
 	// write has been received. This function should return the highest rid
 	// processed by the session
 	ack func() int
+	// sent is called with the bytes of the response once they have been
+	// built. raw is set when the request is a repeat of a request that has
+	// already been responded to, and is written instead of a new response.
+	sent func(r *Request, b []byte)
+	raw  []byte
+	// failed is called if the response could not be written to the client.
+	failed func(r *Request)
+	// ctx is the context of the HTTP request, it is done if the client
+	// disconnects.
+	ctx context.Context
+	// stream is the stream added to the session by this request.
+	stream *Stream
 	sync.Mutex
 }
 
@@ -47,41 +60,143 @@ func NewRequest(rid int, wait time.Duration, sid string, b, response Body, ack f
 
 // Write adds the given elements as the payload for the response body.
 func (r *Request) Write(els ...element.Element) error {
+	return r.WriteStream("", els...)
+}
+
+// WriteStream adds the given elements as the payload for the response body
+// and labels the response with the name of the stream they were written to.
+// If name is empty the response is not labelled.
+func (r *Request) WriteStream(name string, els ...element.Element) error {
 	r.Lock()
 	defer r.Unlock()
 	if r.spent {
 		return ErrRequestClosed
 	}
+	if name != "" {
+		r.response.Stream = name
+	}
 	r.payload = els
 	r.spent = true
 	close(r.proceed)
 	return nil
 }
 
+// Terminate adds the given elements as the payload for the response body and
+// marks the response as terminating the session with the given condition. An
+// empty condition is used for a normal termination of the session.
+func (r *Request) Terminate(condition string, els ...element.Element) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.spent {
+		return ErrRequestClosed
+	}
+	r.response.Type = "terminate"
+	r.response.Condition = condition
+	r.payload = els
+	r.spent = true
+	close(r.proceed)
+	return nil
+}
+
+// replay sets b as the exact response to write for this request.
+func (r *Request) replay(b []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.spent {
+		return ErrRequestClosed
+	}
+	r.raw = b
+	r.spent = true
+	close(r.proceed)
+	return nil
+}
+
+// Close closes the request, causing it to be answered with an empty response.
+// Calling Close more than once has no effect.
 func (r *Request) Close() {
-	close(r.closed)
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+}
+
+// SetContext sets the context of the HTTP request this Request was created
+// from. If the context is done before the response is written, the client is
+// treated as having disconnected and the response is not written.
+func (r *Request) SetContext(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
 }
 
 // RID returns the request ID of this Request.
 func (r *Request) RID() int { return r.rid }
 
+// Stream returns the stream this Request added to its session. It is nil if
+// the Request did not add a stream or has not been processed.
+func (r *Request) Stream() *Stream { return r.stream }
+
 func (r *Request) Elements() []element.Element {
 	return r.body.Children
 }
 
-func (r *Request) Handle(w io.Writer) {
+// empty returns true if the request carries no payload and does not restart,
+// pause, or terminate the stream.
+func (r *Request) empty() bool {
+	return len(r.body.Children) == 0 && !r.body.Restart && r.body.Type == "" &&
+		r.body.Pause == 0
+}
+
+// Handle waits until the request has a response, has been closed, or has
+// timed out, and then writes the response to w. The Content-Type header is
+// set if it has not already been set and responses are never cached.
+//
+// If the response cannot be written, or the client has disconnected, the
+// failure is reported so the payload can be sent in a later response.
+func (r *Request) Handle(w http.ResponseWriter) {
+	var done <-chan struct{}
+	if r.ctx != nil {
+		done = r.ctx.Done()
+	}
 	select {
 	case <-r.proceed:
 	case <-r.closed:
 		r.Lock()
-		defer r.Unlock()
 		r.spent = true
+		r.Unlock()
 	case <-time.After(r.wait):
 		r.Lock()
-		defer r.Unlock()
 		r.spent = true
+		r.Unlock()
+	case <-done:
+		r.Lock()
+		r.spent = true
+		r.Unlock()
+	}
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", defaultContentType)
+	}
+	header.Set("Cache-Control", "no-store")
+	if r.raw != nil {
+		w.Write(r.raw)
+		return
 	}
 	r.response.Ack = r.ack()
 	r.response.Children = r.payload
-	w.Write(r.response.TransformElement().WriteBytes())
+	b := r.response.TransformElement().WriteBytes()
+	if r.sent != nil {
+		r.sent(r, b)
+	}
+	var err error
+	if r.ctx != nil && r.ctx.Err() != nil {
+		err = r.ctx.Err()
+	} else {
+		_, err = w.Write(b)
+	}
+	if err != nil && r.failed != nil {
+		r.failed(r)
+	}
 }
@@ -1,7 +1,10 @@
 package bosh
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strconv"
 	"testing"
@@ -46,6 +49,77 @@ func TestRequestWrite(t *testing.T) {
 	}
 }
 
+func TestRequestTerminate(t *testing.T) {
+	t.Parallel()
+
+	var err, gotErr error
+	r := NewRequest(1, time.Second, "bosh", Body{}, Body{}, func() int { return 0 })
+	r.spent = true
+	// Return ErrRequestClosed if request is spent
+	err = ErrRequestClosed
+	gotErr = r.Terminate("")
+	if !reflect.DeepEqual(err, gotErr) {
+		t.Error("Should return ErrRequestClosed if request is spent")
+		t.Errorf("\nWant:%+v\nGot :%+v", err, gotErr)
+	}
+	// Return nil, set the payload, type and condition, and close the proceed
+	// chan
+	r = NewRequest(1, time.Second, "bosh", Body{}, Body{}, func() int { return 0 })
+	err = nil
+	gotErr = r.Terminate("policy-violation", element.New("foo"))
+	if !reflect.DeepEqual(err, gotErr) {
+		t.Error("Error from Terminate should be nil")
+		t.Errorf("\nWant:%+v\nGot :%+v", err, gotErr)
+	}
+	payload := []element.Element{element.New("foo")}
+	if !reflect.DeepEqual(payload, r.payload) {
+		t.Error("Elements should be added to the payload of the Request")
+		t.Errorf("\nWant:%+v\nGot :%+v", payload, r.payload)
+	}
+	if r.response.Type != "terminate" {
+		t.Error("The response should have a type of terminate")
+		t.Errorf("\nWant:%s\nGot :%s", "terminate", r.response.Type)
+	}
+	if r.response.Condition != "policy-violation" {
+		t.Error("The response should have the given condition")
+		t.Errorf("\nWant:%s\nGot :%s", "policy-violation", r.response.Condition)
+	}
+	if !r.spent {
+		t.Error("The Request should be spent")
+	}
+	select {
+	case <-r.proceed:
+	default:
+		t.Error("The proceed channel should be closed on successful Terminate")
+	}
+}
+
+func TestRequestreplay(t *testing.T) {
+	t.Parallel()
+
+	var b = []byte("<body/>")
+	r := NewRequest(1, time.Second, "bosh", Body{}, Body{}, func() int { return 0 })
+	r.spent = true
+	// Return ErrRequestClosed if request is spent
+	if err := r.replay(b); err != ErrRequestClosed {
+		t.Error("Should return ErrRequestClosed if request is spent")
+	}
+	// Should set raw and close the proceed chan
+	r = NewRequest(1, time.Second, "bosh", Body{}, Body{}, func() int { return 0 })
+	if err := r.replay(b); err != nil {
+		t.Errorf("Unexpected error from replay: %s", err)
+	}
+	if !reflect.DeepEqual(b, r.raw) {
+		t.Error("Should set the raw response")
+		t.Errorf("\nWant:%s\nGot :%s", b, r.raw)
+	}
+	select {
+	case <-r.proceed:
+	default:
+		t.Error("The proceed channel should be closed on successful replay")
+	}
+}
+
 func TestRequestClose(t *testing.T) {
 	t.Parallel()
 
@@ -87,14 +161,15 @@ func TestRequestHandle(t *testing.T) {
 
 	var r *Request
 	var rid int
-	var buf bytes.Buffer
+	var rec *httptest.ResponseRecorder
 
 	// On channel closed:
 	// Should set spent to true
 	rid = 52934
 	r = NewRequest(1, time.Second, "bosh", Body{}, Body{}, func() int { return rid })
 	close(r.closed)
-	r.Handle(&buf)
+	rec = httptest.NewRecorder()
+	r.Handle(rec)
 	if !r.spent {
 		t.Error("The Request should be spent")
 	}
@@ -103,8 +178,8 @@ func TestRequestHandle(t *testing.T) {
 	// Should set spent to true
 	rid = 293849
 	r = NewRequest(1, time.Millisecond, "bosh", Body{}, Body{}, func() int { return rid })
-	buf.Reset()
-	r.Handle(&buf)
+	rec = httptest.NewRecorder()
+	r.Handle(rec)
 	if !r.spent {
 		t.Error("The Request should be spent")
 	}
@@ -116,8 +191,8 @@ func TestRequestHandle(t *testing.T) {
 	payload := []element.Element{element.New("foo"), element.New("bar")}
 	r.payload = payload
 	close(r.proceed)
-	buf.Reset()
-	r.Handle(&buf)
+	rec = httptest.NewRecorder()
+	r.Handle(rec)
 	if r.response.Ack != rid {
 		t.Error("Should set Ack if the ack has not been set")
 		t.Errorf("\nWant:%d\nGot :%d", rid, r.response.Ack)
@@ -126,7 +201,7 @@ func TestRequestHandle(t *testing.T) {
 		t.Error("Should add payload to the response's children")
 		t.Errorf("\nWant:%+v\nGot :%+v", payload, r.response.Children)
 	}
-	got := buf.Bytes()
+	got := rec.Body.Bytes()
 	want := body.
 		AddAttr("ack", strconv.Itoa(rid)).
 		AddChild(payload[0]).
@@ -134,7 +209,102 @@ func TestRequestHandle(t *testing.T) {
 		WriteBytes()
 
 	if !reflect.DeepEqual(want, got) {
-		t.Error("Should write response to the given io.Writer")
+		t.Error("Should write response to the given http.ResponseWriter")
 		t.Errorf("\nWant:%s\nGot :%s", want, got)
 	}
+
+	// Should pass the response to sent
+	var sent []byte
+	r = NewRequest(1, 5*time.Second, "bosh", Body{}, Body{}, func() int { return rid })
+	r.sent = func(_ *Request, b []byte) { sent = b }
+	close(r.proceed)
+	rec = httptest.NewRecorder()
+	r.Handle(rec)
+	if !reflect.DeepEqual(rec.Body.Bytes(), sent) {
+		t.Error("Should pass the response to sent")
+		t.Errorf("\nWant:%s\nGot :%s", rec.Body.Bytes(), sent)
+	}
+
+	// Should write the raw response for a repeated request
+	r = NewRequest(1, 5*time.Second, "bosh", Body{}, Body{}, func() int { return rid })
+	r.replay([]byte("<body ack='12'/>"))
+	rec = httptest.NewRecorder()
+	r.Handle(rec)
+	if rec.Body.String() != "<body ack='12'/>" {
+		t.Error("Should write the raw response for a repeated request")
+		t.Errorf("\nWant:%s\nGot :%s", "<body ack='12'/>", rec.Body.String())
+	}
+}
+
+// failWriter is an http.ResponseWriter whose writes always fail.
+type failWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestRequestHandleHeaders(t *testing.T) {
+	t.Parallel()
+
+	// Should set the Content-Type and Cache-Control headers
+	r := NewRequest(1, time.Millisecond, "bosh", Body{}, Body{}, func() int { return 1 })
+	rec := httptest.NewRecorder()
+	r.Handle(rec)
+	if got := rec.Header().Get("Content-Type"); got != defaultContentType {
+		t.Error("Should set the Content-Type header")
+		t.Errorf("\nWant:%s\nGot :%s", defaultContentType, got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Error("Should set the Cache-Control header")
+		t.Errorf("\nWant:%s\nGot :%s", "no-store", got)
+	}
+	if rec.Code != http.StatusOK {
+		t.Error("Should respond with 200 OK")
+	}
+
+	// Should not replace a Content-Type that has already been set
+	r = NewRequest(1, time.Millisecond, "bosh", Body{}, Body{}, func() int { return 1 })
+	rec = httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/xml")
+	r.Handle(rec)
+	if got := rec.Header().Get("Content-Type"); got != "application/xml" {
+		t.Error("Should not replace a Content-Type that has already been set")
+		t.Errorf("\nWant:%s\nGot :%s", "application/xml", got)
+	}
+}
+
+func TestRequestHandleFailed(t *testing.T) {
+	t.Parallel()
+
+	var failed *Request
+
+	// Should report a failed write
+	r := NewRequest(1, 5*time.Second, "bosh", Body{}, Body{}, func() int { return 1 })
+	r.failed = func(r *Request) { failed = r }
+	r.Write(element.New("foo"))
+	r.Handle(failWriter{httptest.NewRecorder()})
+	if failed != r {
+		t.Error("Should report a failed write")
+	}
+
+	// Should not write the response if the client has disconnected
+	failed = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	r = NewRequest(1, 5*time.Second, "bosh", Body{}, Body{}, func() int { return 1 }).SetContext(ctx)
+	r.failed = func(r *Request) { failed = r }
+	cancel()
+	rec := httptest.NewRecorder()
+	r.Handle(rec)
+	if rec.Body.Len() != 0 {
+		t.Error("Should not write the response if the client has disconnected")
+		t.Errorf("\nGot :%s", rec.Body.Bytes())
+	}
+	if failed != r {
+		t.Error("Should report a disconnected client as a failed write")
+	}
+	if r.Write(element.New("foo")) != ErrRequestClosed {
+		t.Error("Should spend the request if the client has disconnected")
+	}
 }
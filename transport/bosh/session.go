@@ -3,9 +3,12 @@ package bosh
 import (
 	"errors"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/skriptble/gabble/transport/internal/xmpp"
 	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
 	"github.com/skriptble/nine/stream"
 )
 
@@ -13,45 +16,171 @@ import (
 // call to Element is made.
 var ErrSessionClosed = errors.New("Session is closed")
 
+// ErrInvalidKey is the error returned when the key sent with a request does
+// not match the session's key sequence.
+var ErrInvalidKey = errors.New("invalid key")
+
 type Session struct {
-	processor chan *Request
-	restart   chan struct{}
-	elements  chan element.Element
-	responder chan element.Element
+	processor  chan *Request
+	restart    chan struct{}
+	elements   chan element.Element
+	responder  chan element.Element
+	terminator chan termination
+	pauser     chan *Request
+	// requeue receives payloads that could not be written to the client.
+	requeue chan []element.Element
 
 	expired bool
+	// legacy is true if the client did not send a version when creating the
+	// session.
+	legacy bool
+	// accept is the content encodings the client accepts for responses.
+	accept string
+	// content is the Content-Type the client requested for responses.
+	content string
+	// restartable is true once the client has authenticated and until it
+	// restarts the stream.
+	restartable bool
+
+	// timer closes the session once its inactivity period has passed, which
+	// is measured from expiry. paused is the length of the next inactivity
+	// period if the client has paused the session.
+	timer  *time.Timer
+	expiry time.Time
+	paused time.Duration
+	// err is the condition the session was terminated with by the server.
+	err *TerminateError
+	// hooks observe the lifecycle of the session.
+	hooks Hooks
 
 	exit chan struct{}
+	lock sync.Mutex
+	// wg tracks the goroutines of the session and its streams, done is closed
+	// once they have all exited.
+	wg   sync.WaitGroup
+	done chan struct{}
 
 	// current is the current RID being processed
 	current int
 	// ack is the highest RID that has been processed
 	ack        int
 	sid        string
+	domain     string
+	route      string
+	hold       int
 	wait       time.Duration
 	inactivity time.Duration
+	// maxpause is the longest the client may pause the session for. If it is
+	// 0 the client may not pause the session.
+	maxpause time.Duration
+
+	// requests is the maximum number of simultaneous requests the client may
+	// make and polling is the shortest allowable interval between empty
+	// requests in a polling session. A requests value of 0 disables the
+	// overactivity checks.
+	requests int
+	polling  time.Duration
+	// held are the requests that have been received but not yet responded to,
+	// keyed by RID, and responded is the time the last response was sent.
+	held      map[int]*Request
+	responded time.Time
+	// history holds the last hold+1 responses sent to the client, keyed by
+	// RID, so they can be sent again if the client repeats a request.
+	// waiting are the repeated requests waiting for the response to a held
+	// request.
+	history map[int][]byte
+	waiting map[int][]*Request
+	// seen are the RIDs above ack that have been received, so a request that
+	// is retransmitted before it has been processed in order is recognised.
+	seen map[int]struct{}
+	// unacked holds the time each response in the history was sent until the
+	// client acknowledges it. acks is true if the client enabled
+	// acknowledgements when it created the session, only then are its acks
+	// processed and are unacknowledged responses kept in the history.
+	unacked map[int]time.Time
+	acks    bool
+	// stream is the name of the session's first stream, it is empty if the
+	// session does not support multiple streams. streams are the additional
+	// streams that have been added to the session. queue is the queue of
+	// requests shared by all of the streams.
+	stream  string
+	streams map[string]*Stream
+	queue   chan *Request
+
+	// key is the key the next request's key must hash to and keyRID is the
+	// RID of the last verified request. keySent is the key that was sent with
+	// that request, it differs from key if the request included a newkey. If
+	// key is empty the client is not using key sequencing.
+	key     string
+	keyRID  int
+	keySent string
 }
 
 // NewSession creates a new session and returns it.
 func NewSession(sid string, rid, hold int, wait, inactivity time.Duration) *Session {
+	return NewSessionFromResponse(rid, Body{
+		SID:        sid,
+		Hold:       hold,
+		Wait:       wait,
+		Inactivity: inactivity,
+	})
+}
+
+// NewSessionFromResponse creates a new session from the session creation
+// response sent to the client and returns it. The rid is the request ID of the
+// session creation request.
+func NewSessionFromResponse(rid int, rsp Body) *Session {
 	s := new(Session)
-	s.sid = sid
+	s.sid = rsp.SID
+	s.domain = rsp.To
 	s.current = rid
-	s.wait = wait
-	s.inactivity = inactivity
+	s.hold = rsp.Hold
+	s.wait = rsp.Wait
+	s.inactivity = rsp.Inactivity
+	s.maxpause = rsp.MaxPause
+	s.requests = rsp.Requests
+	s.polling = rsp.Polling
+	s.held = make(map[int]*Request)
+	s.history = make(map[int][]byte)
+	s.waiting = make(map[int][]*Request)
+	s.unacked = make(map[int]time.Time)
+	s.stream = rsp.Stream
+	s.streams = make(map[string]*Stream)
 
 	s.processor = make(chan *Request)
 	s.elements = make(chan element.Element)
 	s.responder = make(chan element.Element)
 	s.restart = make(chan struct{}, 1)
+	s.terminator = make(chan termination)
+	s.pauser = make(chan *Request)
+	s.requeue = make(chan []element.Element)
 	s.exit = make(chan struct{})
 
-	requests := make(chan *Request, hold)
+	requests := make(chan *Request, s.hold)
 	buffer := make(chan element.Element)
+	s.queue = requests
+	s.lock.Lock()
+	s.idle(time.Now())
+	s.lock.Unlock()
 
-	go s.process(requests, buffer)
-	go s.response(requests)
-	go s.buffer(buffer)
+	s.done = make(chan struct{})
+	s.wg.Add(3)
+	go func() {
+		defer s.wg.Done()
+		s.process(requests, buffer)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.response(requests)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.buffer(buffer)
+	}()
+	go func() {
+		s.wg.Wait()
+		close(s.done)
+	}()
 	return s
 }
 
@@ -63,10 +192,21 @@ func (s *Session) Write(el element.Element) (err error) {
 	case <-s.exit:
 		err = stream.ErrStreamClosed
 	case s.responder <- el:
+		if authenticated(el) {
+			s.lock.Lock()
+			s.restartable = true
+			s.lock.Unlock()
+		}
 	}
 	return
 }
 
+// authenticated returns true if el reports a successful SASL authentication,
+// after which the client must restart the stream.
+func authenticated(el element.Element) bool {
+	return el.Tag == "success" && el.SelectAttrValue("xmlns", "") == namespace.SASL
+}
+
 // UnregisterRequest returns a function that can be called to remove the given
 // request from the registered requests for this session. This method is mainly
 // used as the timeout variable for a request so that a request that has timed
@@ -76,17 +216,66 @@ func (s *Session) UnregisterRequest() func() int {
 }
 
 // Close implements io.Closer.
-// TODO: This has a race condition, put a lock around it.
 func (s *Session) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	select {
 	case <-s.exit:
 		return errors.New("Already closed")
 	default:
 	}
 	close(s.exit)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	for _, st := range s.streams {
+		st.close()
+	}
 	return nil
 }
 
+// AddStream adds a new stream to the session for the given domain and returns
+// it. The stream is closed when the session is closed. If the session has been
+// closed no stream is added and nil is returned.
+func (s *Session) AddStream(to string) *Stream {
+	return s.addStream(xmpp.StreamID(), to)
+}
+
+// addStream adds a stream with the given name to the session. The stream's
+// goroutines are added to the session's under the lock, so they are either
+// waited for by Done or never started.
+func (s *Session) addStream(name, to string) *Stream {
+	st := newStream(s, name, to)
+	s.lock.Lock()
+	select {
+	case <-s.exit:
+		s.lock.Unlock()
+		return nil
+	default:
+	}
+	if s.streams == nil {
+		s.streams = make(map[string]*Stream)
+	}
+	s.streams[st.name] = st
+	s.wg.Add(2)
+	s.lock.Unlock()
+	st.run()
+	return st
+}
+
+// lookup returns the stream with the given name. The stream is nil if name
+// refers to the session's first stream. If there is no stream with the given
+// name false is returned.
+func (s *Session) lookup(name string) (*Stream, bool) {
+	if name == "" || name == s.stream {
+		return nil, true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.streams[name]
+	return st, ok
+}
+
 // Element returns the next element from the session.
 func (s *Session) Element() (el element.Element, err error) {
 	select {
@@ -101,61 +290,583 @@ func (s *Session) Element() (el element.Element, err error) {
 	return
 }
 
-// Process processes a request
+// Process processes a request. If the session has been closed
+// ErrSessionClosed is returned. If the client is overactive, as described in
+// http://xmpp.org/extensions/xep-0124.html#overactive, the session is
+// terminated and ErrPolicyViolation is returned.
+//
+// A request with an RID that has already been received is answered with the
+// response originally sent for that RID. If that response is no longer
+// available, or the RID is beyond the window of requests the client may have
+// outstanding, the session is terminated and ErrItemNotFound is returned.
+//
+// If the session is using key sequencing and the key sent with the request
+// does not match, ErrInvalidKey is returned. The session is not terminated,
+// since the request may not have been sent by the client. The key is verified
+// before a response is replayed.
 //
-// TODO: Handle processing of repeated requests
-// TODO: Handle overactivity as described in
-// http://xmpp.org/extensions/xep-0124.html#overactive
+// A request that pauses the session is answered immediately along with every
+// held request, and the session's inactivity period is extended to the
+// requested pause, capped at the session's maxpause.
+//
+// A request that adds a stream creates the stream named by the request's
+// response once the request has been accepted. A repeated request does not
+// create another stream. The stream is available from the request's Stream
+// method.
 func (s *Session) Process(r *Request) error {
-	s.processor <- r
+	r.sent = s.sent
+	r.failed = s.failed
+	if r.body.Pause > s.maxpause {
+		r.body.Pause = s.maxpause
+	}
+	if err := s.verify(r); err != nil {
+		return ErrInvalidKey
+	}
+	repeated, err := s.repeat(r)
+	if err != nil {
+		s.fail(err)
+		return err
+	}
+	if repeated {
+		return nil
+	}
+	st, ok := s.lookup(r.body.Stream)
+	if !ok {
+		log.Println("Request for unknown stream ", r.body.Stream)
+		s.fail(ErrItemNotFound)
+		return ErrItemNotFound
+	}
+	if r.body.Restart {
+		if err := s.checkRestart(r, st); err != nil {
+			s.fail(err)
+			return err
+		}
+	}
+	now := time.Now()
+	if err := s.admit(r, now); err != nil {
+		s.fail(err)
+		return err
+	}
+	if r.body.Ack != 0 {
+		s.acknowledge(r, now)
+	}
+	if s.adding(r.body) {
+		if r.stream = s.addStream(r.response.Stream, r.body.To); r.stream == nil {
+			return s.closed()
+		}
+	}
+	hooks := s.observer()
+	hooks.OnRequest(s, r.body)
+	if r.body.Restart {
+		var name string
+		if st != nil {
+			name = st.Name()
+		}
+		hooks.OnRestart(s, name)
+	}
+	select {
+	case <-s.exit:
+		if r.stream != nil {
+			r.stream.close()
+		}
+		return s.closed()
+	case s.processor <- r:
+	}
 	return nil
 }
 
+// closed returns the error for a request made after the session has been
+// closed. If the server terminated the session its condition is returned.
+func (s *Session) closed() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return ErrSessionClosed
+}
+
+// checkRestart validates a request to restart the stream st, which is nil for
+// the session's first stream. A restart must not carry a payload and may only
+// follow a successful SASL authentication on the stream.
+func (s *Session) checkRestart(r *Request, st *Stream) *TerminateError {
+	if len(r.body.Children) != 0 {
+		log.Println("Restart request with payload ", r.RID())
+		return ErrBadRequest
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	restartable := &s.restartable
+	if st != nil {
+		restartable = &st.restartable
+	}
+	if !*restartable {
+		log.Println("Restart request before authentication ", r.RID())
+		return ErrBadRequest
+	}
+	*restartable = false
+	return nil
+}
+
+// admit records r as outstanding. If accepting r would make the client
+// overactive ErrPolicyViolation is returned and r is not recorded.
+//
+// A client may not have more than the negotiated number of requests
+// outstanding, although one additional request is allowed if it pauses or
+// terminates the session. In a polling session, one with a hold of 0, the
+// client may not send an empty request sooner than the polling interval after
+// the last response.
+func (s *Session) admit(r *Request, now time.Time) *TerminateError {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.requests != 0 {
+		limit := s.requests
+		if r.body.Type == "terminate" || r.body.Pause != 0 {
+			limit++
+		}
+		if len(s.held)+1 > limit {
+			log.Printf("Too many simultaneous requests: %d", len(s.held)+1)
+			return ErrPolicyViolation
+		}
+		if s.hold == 0 && len(s.held) == 0 && r.empty() &&
+			!s.responded.IsZero() && now.Sub(s.responded) < s.polling {
+			log.Println("Polling too frequently")
+			return ErrPolicyViolation
+		}
+	}
+	if s.held == nil {
+		s.held = make(map[int]*Request)
+	}
+	s.held[r.RID()] = r
+	// The session is not inactive while a request is held. A pause applies
+	// to the next period without held requests.
+	s.paused = r.body.Pause
+	s.busy()
+	return nil
+}
+
+// idle starts the inactivity period of the session, this happens whenever
+// the session is holding no requests. If the client paused the session the
+// period lasts for the pause instead. The caller must hold s.lock.
+func (s *Session) idle(now time.Time) {
+	period := s.inactivity
+	if s.paused != 0 {
+		period = s.paused
+	}
+	if period <= 0 {
+		return
+	}
+	s.expiry = now.Add(period)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(period, s.expire)
+		return
+	}
+	s.timer.Reset(period)
+}
+
+// busy stops the inactivity period of the session. The caller must hold
+// s.lock.
+func (s *Session) busy() {
+	s.expiry = time.Time{}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// expire closes the session if its inactivity period has passed without the
+// client making a request.
+func (s *Session) expire() {
+	s.lock.Lock()
+	if len(s.held) != 0 || s.expiry.IsZero() || time.Now().Before(s.expiry) {
+		s.lock.Unlock()
+		return
+	}
+	s.expired = true
+	s.lock.Unlock()
+	log.Println("session expiring")
+	s.observer().OnExpired(s)
+	s.Close()
+}
+
+// repeat handles a request whose RID has already been received. If the
+// response for the RID is in the history it is replayed. If the original
+// request is still being held it is answered immediately and its response is
+// also sent to r, and if the original request has not yet been answered r
+// waits for its response. Otherwise ErrItemNotFound is returned. A request
+// whose RID is beyond the window of requests the client may have outstanding
+// also returns ErrItemNotFound. repeat returns false if r is not a repeated
+// request.
+func (s *Session) repeat(r *Request) (bool, *TerminateError) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rid := r.RID()
+	last := s.ack
+	if last == 0 {
+		last = s.current - 1
+	}
+	if s.requests != 0 {
+		limit := s.requests
+		if r.body.Type == "terminate" || r.body.Pause != 0 {
+			limit++
+		}
+		if rid > last+limit {
+			log.Println("Request outside of the window ", rid)
+			return true, ErrItemNotFound
+		}
+	}
+	if b, ok := s.history[rid]; ok {
+		log.Println("Replaying response ", rid)
+		r.replay(b)
+		return true, nil
+	}
+	if orig, ok := s.held[rid]; ok {
+		log.Println("Waiting for response ", rid)
+		s.await(r)
+		orig.Close()
+		return true, nil
+	}
+	if _, ok := s.seen[rid]; ok {
+		log.Println("Waiting for response ", rid)
+		s.await(r)
+		return true, nil
+	}
+	if rid <= last {
+		log.Println("Response no longer available ", rid)
+		return true, ErrItemNotFound
+	}
+	if s.seen == nil {
+		s.seen = make(map[int]struct{})
+	}
+	for seen := range s.seen {
+		if seen <= last {
+			delete(s.seen, seen)
+		}
+	}
+	s.seen[rid] = struct{}{}
+	return false, nil
+}
+
+// await makes r wait for the response to the request with the same RID. The
+// caller must hold s.lock.
+func (s *Session) await(r *Request) {
+	if s.waiting == nil {
+		s.waiting = make(map[int][]*Request)
+	}
+	s.waiting[r.RID()] = append(s.waiting[r.RID()], r)
+}
+
+// setKey starts key sequencing for the session with the newkey sent with the
+// session creation request. The session creation request itself carries no
+// key.
+func (s *Session) setKey(rid int, key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.key = key
+	s.keyRID = rid
+}
+
+// verify checks the key sent with r if the session is using key sequencing.
+// If the key does not match ErrItemNotFound is returned. A request that is not
+// later than the last verified request, such as a retransmission, must carry
+// the key that was sent with its RID. If r includes a newkey the key sequence
+// is replaced.
+func (s *Session) verify(r *Request) *TerminateError {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.key == "" {
+		return nil
+	}
+	var ok bool
+	switch key := r.body.Key; {
+	case r.RID() == s.keyRID:
+		ok = key == s.keySent
+	case r.RID() < s.keyRID:
+		ok = key != "" && verifyKey(key, r.RID(), s.keySent, s.keyRID)
+	default:
+		ok = key != "" && verifyKey(key, r.RID(), s.key, s.keyRID)
+	}
+	if !ok {
+		log.Println("Invalid key for request ", r.RID())
+		return ErrItemNotFound
+	}
+	if r.RID() <= s.keyRID {
+		return nil
+	}
+	s.key, s.keyRID, s.keySent = r.body.Key, r.RID(), r.body.Key
+	if r.body.NewKey != "" {
+		s.key = r.body.NewKey
+	}
+	return nil
+}
+
+// reportDelay is how long the client has to acknowledge a response before it
+// is reported as missing.
+const reportDelay = 2 * time.Second
+
+// acknowledge removes the responses acknowledged by r from the unacknowledged
+// responses. If the client has not acknowledged a response that was sent
+// longer than reportDelay ago, the lowest such RID is reported in the response
+// to r so the client can request it again. Acks are ignored if the client did
+// not enable them when it created the session.
+func (s *Session) acknowledge(r *Request, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.acks {
+		return
+	}
+	var report int
+	for rid, t := range s.unacked {
+		if rid <= r.body.Ack {
+			delete(s.unacked, rid)
+			continue
+		}
+		if now.Sub(t) > reportDelay && (report == 0 || rid < report) {
+			report = rid
+		}
+	}
+	if report != 0 {
+		log.Println("Reporting missing response ", report)
+		r.response.Report = report
+		r.response.Time = now.Sub(s.unacked[report])
+	}
+}
+
+// sent records the response b sent for the request r. The request is no
+// longer held, the response is added to the history, and any repeated
+// requests waiting on the response are answered. The history holds the last
+// hold+1 responses and any older responses the client has not acknowledged.
+func (s *Session) sent(r *Request, b []byte) {
+	s.observer().OnResponse(s, r.response)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.held[r.RID()] == r {
+		delete(s.held, r.RID())
+	}
+	s.responded = time.Now()
+	if len(s.held) == 0 {
+		s.idle(s.responded)
+	}
+	if s.history == nil {
+		s.history = make(map[int][]byte)
+	}
+	s.history[r.RID()] = b
+	if s.acks {
+		if s.unacked == nil {
+			s.unacked = make(map[int]time.Time)
+		}
+		s.unacked[r.RID()] = s.responded
+	}
+	// Responses the client has not acknowledged are kept so they can be
+	// sent again once the client reports them missing.
+	for rid := range s.history {
+		if _, ok := s.unacked[rid]; ok {
+			continue
+		}
+		if rid <= r.RID()-(s.hold+1) {
+			delete(s.history, rid)
+		}
+	}
+	for _, w := range s.waiting[r.RID()] {
+		w.replay(b)
+	}
+	delete(s.waiting, r.RID())
+}
+
+// failed handles a response that could not be written to the client. The
+// recorded response is replaced with an empty body, so a retransmission of
+// the request does not deliver the payload a second time, and the payload is
+// sent in a later response on the same stream.
+func (s *Session) failed(r *Request) {
+	r.Lock()
+	rsp := r.response
+	payload := r.payload
+	r.Unlock()
+	rsp.Children = nil
+	s.lock.Lock()
+	if _, ok := s.history[r.RID()]; ok {
+		s.history[r.RID()] = rsp.TransformElement().WriteBytes()
+	}
+	delete(s.unacked, r.RID())
+	st := s.streams[rsp.Stream]
+	s.lock.Unlock()
+	if len(payload) == 0 || rsp.Type == "terminate" {
+		return
+	}
+	log.Println("Requeueing payload for request ", r.RID())
+	requeue, exit := s.requeue, s.exit
+	if st != nil {
+		requeue, exit = st.requeue, st.exit
+	}
+	select {
+	case <-exit:
+	case requeue <- payload:
+	}
+}
+
+// fail terminates the session with the given condition. Every held request is
+// answered with a terminate body and the session is closed.
+func (s *Session) fail(err *TerminateError) {
+	s.lock.Lock()
+	select {
+	case <-s.exit:
+		s.lock.Unlock()
+		return
+	default:
+	}
+	first := s.err == nil
+	if first {
+		s.err = err
+	}
+	s.lock.Unlock()
+	if first {
+		s.observer().OnTerminated(s, err.Condition)
+	}
+	select {
+	case <-s.exit:
+		return
+	case s.terminator <- termination{condition: err.Condition, payload: err.payload()}:
+	}
+	s.Close()
+}
+
+// Terminate ends the session with the given terminal binding condition. Held
+// requests are answered with the condition and later requests receive it as
+// an error from Process. This is used when something outside of the session,
+// such as the connection to an upstream server, fails.
+func (s *Session) Terminate(err *TerminateError) {
+	s.fail(err)
+}
+
+// termination is sent to the response goroutine when the session is ending.
+// The request r is answered last and receives any payload that has not yet
+// been written. The request is nil if the server is ending the session.
+type termination struct {
+	r         *Request
+	condition string
+	payload   []element.Element
+}
+
 // elementRunner handles processing elements from requests and adding requests
 // to a queue of available requests for writers to use. If the buffer is filled
 // the oldest request is removed closed and the recieved request is added to the
 // buffer. This method ensures that requests' elements are buffered in order to
 // meet the requirement of in-order processing.
+//
+// In a polling session, one with a hold of 0, the queue is unbuffered. A
+// request is only taken if there is a response waiting to be sent, otherwise
+// it is closed and answered immediately.
 func (s *Session) process(queue chan *Request, buffer chan<- element.Element) {
 	var requests map[int]*Request = make(map[int]*Request)
 	var current int = s.current
+	var terminated bool
 	for {
 		select {
 		case <-s.exit:
 			return
-		case <-time.After(s.inactivity):
-			log.Println("session expiring")
-			s.expired = true
-			s.Close()
-			return
 		case r := <-s.processor:
-			// Handle history request
-			if r.RID() < current {
+			// The session is being torn down, any further requests are
+			// answered immediately.
+			if terminated {
+				r.Terminate("")
+				continue
 			}
 			requests[r.RID()] = r
 			log.Println("processing request")
-			select {
-			case queue <- r:
-			case old := <-queue:
-				log.Println("Removing old requests ", old.RID())
-				old.Close()
-				queue <- r
-			default:
-				r.Close()
+			// Pause, terminate, and add stream requests are answered once
+			// they have been processed, so they are not made available to
+			// writers.
+			if r.body.Type != "terminate" && r.body.Pause == 0 && !s.adding(r.body) {
+				select {
+				case queue <- r:
+				case old := <-queue:
+					log.Println("Removing old requests ", old.RID())
+					old.Close()
+					queue <- r
+				default:
+					r.Close()
+				}
 			}
 			if r.body.Restart == true {
 				log.Println("Seneding restart")
-				s.restart <- struct{}{}
+				switch st, known := s.lookup(r.body.Stream); {
+				case st != nil:
+					select {
+					case st.restart <- struct{}{}:
+					case <-st.exit:
+					}
+				case known:
+					s.restart <- struct{}{}
+				}
 			}
 			log.Println("Reqeusts queued")
 			for r, ok := requests[current]; ok; r, ok = requests[current] {
+				st, known := s.lookup(r.body.Stream)
 				for _, el := range r.Elements() {
 					log.Println("Buffered element")
-					buffer <- el
+					switch {
+					case st != nil:
+						select {
+						case st.buffer <- el:
+						case <-st.exit:
+						}
+					case known:
+						select {
+						case buffer <- el:
+						case <-s.exit:
+							return
+						}
+					}
 				}
+				s.lock.Lock()
 				s.ack = r.RID()
+				s.lock.Unlock()
 				log.Println("Increasing ack")
+				delete(requests, current)
 				current++
+				if !known {
+					log.Println("Request for unknown stream ", r.body.Stream)
+					r.Close()
+					continue
+				}
+				if s.adding(r.body) {
+					log.Println("stream added")
+					r.Write()
+					continue
+				}
+				// Terminating one of the additional streams does not end the
+				// session. Closing the stream's buffer lets it read the
+				// remaining elements before it is closed.
+				if st != nil && r.body.Type == "terminate" {
+					log.Println("stream terminating ", st.Name())
+					s.lock.Lock()
+					delete(s.streams, st.Name())
+					s.lock.Unlock()
+					close(st.buffer)
+					r.WriteStream(st.Name())
+					continue
+				}
+				if r.body.Pause != 0 {
+					log.Println("session pausing")
+					select {
+					case <-s.exit:
+						return
+					case s.pauser <- r:
+					}
+				}
+				if r.body.Type == "terminate" {
+					log.Println("session terminating")
+					terminated = true
+					s.observer().OnTerminated(s, r.body.Condition)
+					select {
+					case <-s.exit:
+						return
+					case s.terminator <- termination{r: r}:
+					}
+					// Closing the buffer lets the stream read the remaining
+					// elements before the session is closed.
+					close(buffer)
+					break
+				}
 			}
 		}
 	}
@@ -165,18 +876,36 @@ func (s *Session) process(queue chan *Request, buffer chan<- element.Element) {
 // one for a call to Element(). This is necessary because the runner cannot be
 // blocked waiting for a call to Element, but we only want to send an element
 // down the elements channel when we have one ready.
+//
+// When the buffer channel is closed the remaining elements are handed out and
+// then the session is closed.
 func (s *Session) buffer(buffer <-chan element.Element) {
+	bufferElements(buffer, s.elements, s.exit, func() { s.Close() })
+}
+
+// bufferElements moves elements from buffer to elements without blocking the
+// sender on buffer. It returns when exit is closed, or calls done and returns
+// once buffer has been closed and every element has been handed out.
+func bufferElements(buffer <-chan element.Element, out chan<- element.Element, exit <-chan struct{}, done func()) {
 	var elements []element.Element
 	var current element.Element
 	var pending bool
 	for {
+		if !pending && buffer == nil {
+			done()
+			return
+		}
 		if pending {
 			select {
-			case <-s.exit:
+			case <-exit:
 				return
-			case el := <-buffer:
+			case el, ok := <-buffer:
+				if !ok {
+					buffer = nil
+					continue
+				}
 				elements = append(elements, el)
-			case s.elements <- current:
+			case out <- current:
 				if len(elements) > 0 {
 					current, elements = elements[0], elements[1:]
 					pending = true
@@ -186,12 +915,16 @@ func (s *Session) buffer(buffer <-chan element.Element) {
 			}
 		} else {
 			select {
-			case <-s.exit:
+			case <-exit:
 				return
 			// The only way to get here is if there are no elements in the
 			// slice, therefore we can assign directly to current and set
 			// pending to true.
-			case el := <-buffer:
+			case el, ok := <-buffer:
+				if !ok {
+					buffer = nil
+					continue
+				}
 				current = el
 				pending = true
 			}
@@ -199,15 +932,47 @@ func (s *Session) buffer(buffer <-chan element.Element) {
 	}
 }
 
+// adding returns true if b is a request to add a stream to the session.
+func (s *Session) adding(b Body) bool {
+	return s.stream != "" && b.SID != "" && b.To != "" && b.Stream == "" &&
+		!b.Restart
+}
+
 func (s *Session) response(queue <-chan *Request) {
+	s.respond(queue, s.stream, s.responder, s.requeue, s.exit, true)
+}
+
+// respond writes the elements received on responder to requests taken from
+// queue, labelling each response with the name of the stream if it has one.
+// Each stream in a session has its own respond goroutine and they share the
+// queue of requests. Only the default stream's goroutine, the one with control
+// set, handles pausing and terminating the session.
+func (s *Session) respond(queue <-chan *Request, name string, responder <-chan element.Element, requeue <-chan []element.Element, exit <-chan struct{}, control bool) {
 	var response []element.Element = make([]element.Element, 0, 10)
 	var timeout time.Duration
+	var terminator <-chan termination
+	var pauser <-chan *Request
+	if control {
+		terminator, pauser = s.terminator, s.pauser
+	}
 
 	for {
 		select {
-		case <-s.exit:
+		case <-exit:
 			return
-		case el := <-s.responder:
+		case t := <-terminator:
+			s.terminate(t, queue, response)
+			response = make([]element.Element, 0, 10)
+			continue
+		case r := <-pauser:
+			s.pause(r, queue, response)
+			response = make([]element.Element, 0, 10)
+			continue
+		case els := <-requeue:
+			// A payload that could not be delivered is sent before
+			// anything written since.
+			response = append(els, response...)
+		case el := <-responder:
 			response = append(response, el)
 			timeout = 50 * time.Millisecond
 			// Exponentially decay the timeout for flushing. This allows to have
@@ -217,42 +982,161 @@ func (s *Session) response(queue <-chan *Request) {
 				select {
 				case <-time.After(timeout):
 					break loop
-				case el := <-s.responder:
+				case el := <-responder:
 					response = append(response, el)
 					timeout = timeout / 2
 				}
 			}
+		}
 
-			for {
-				// Get a request
-				r := <-queue
+	request:
+		for {
+			// A request that is already waiting is written to first, any
+			// elements written after the flush go in the next response.
+			select {
+			case r := <-queue:
+				if r.WriteStream(name, response...) == ErrRequestClosed {
+					continue
+				}
+				break request
+			default:
+			}
+			// Get a request. Elements written while waiting are added to
+			// the response so the stream is not blocked, this is how
+			// elements accumulate between requests in a polling session.
+			select {
+			case <-exit:
+				return
+			case el := <-responder:
+				response = append(response, el)
+			case els := <-requeue:
+				response = append(els, response...)
+			case t := <-terminator:
+				s.terminate(t, queue, response)
+				break request
+			case r := <-pauser:
+				s.pause(r, queue, response)
+				break request
+			case r := <-queue:
 				// Write the response to the request
-				err := r.Write(response...)
+				err := r.WriteStream(name, response...)
 				if err == ErrRequestClosed {
 					continue
 				}
-				break
+				break request
 			}
-			// Create a history entry for the response
-			response = make([]element.Element, 0, 10)
 		}
+		// Create a history entry for the response
+		response = make([]element.Element, 0, 10)
+	}
+}
+
+// flush returns response with any elements that have been written to the
+// session but not yet collected appended to it.
+func (s *Session) flush(response []element.Element) []element.Element {
+	for {
+		select {
+		case el := <-s.responder:
+			response = append(response, el)
+		default:
+			return response
+		}
+	}
+}
+
+// pause answers every held request. The request that paused the session
+// receives any payload that has not yet been sent.
+func (s *Session) pause(r *Request, queue <-chan *Request, response []element.Element) {
+	response = s.flush(response)
+	for {
+		select {
+		case held := <-queue:
+			held.Write()
+			continue
+		default:
+		}
+		break
+	}
+	r.Write(response...)
+}
+
+// terminate flushes any elements that have been written to the session but
+// not yet sent and answers every held request with a terminate body. The
+// request that caused the termination receives the remaining payload.
+func (s *Session) terminate(t termination, queue <-chan *Request, response []element.Element) {
+	response = s.flush(response)
+	for {
+		select {
+		case r := <-queue:
+			r.Terminate(t.condition, t.payload...)
+			continue
+		default:
+		}
+		break
+	}
+	if t.r != nil {
+		t.r.Terminate(t.condition, append(response, t.payload...)...)
 	}
 }
 
 // Ack returns the highest RID the session has processed.
 func (s *Session) Ack() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.ack
 }
 
+// Domain returns the domain the client requested when creating the session.
+func (s *Session) Domain() string {
+	return s.domain
+}
+
+// Route returns the route the client requested when creating the session, an
+// empty string is returned if the client did not request one.
+func (s *Session) Route() string {
+	return s.route
+}
+
+// ContentType returns the Content-Type of responses for this session.
+func (s *Session) ContentType() string {
+	if s.content == "" {
+		return defaultContentType
+	}
+	return s.content
+}
+
 // SID returns the session ID of this session.
 func (s *Session) SID() string {
 	return s.sid
 }
 
 func (s *Session) Expired() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.expired
 }
 
+// Done returns a channel that is closed once the session has been closed and
+// the goroutines of the session and its streams have exited.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Expiry returns the time the session expires if the client does not make
+// another request. The zero time is returned while requests are being held,
+// since the session cannot expire while it is holding a request.
+func (s *Session) Expiry() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.expiry
+}
+
+// Legacy returns true if the client expects the deprecated HTTP error codes
+// instead of terminal binding conditions.
+func (s *Session) Legacy() bool {
+	return s.legacy
+}
+
 func (s *Session) Wait() time.Duration {
 	return s.wait
 }
@@ -5,7 +5,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/skriptble/gabble/transport/internal/transporttest"
 	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
 	"github.com/skriptble/nine/stream"
 )
 
@@ -60,6 +62,471 @@ func TestSessionUnregisterRequest(t *testing.T) {
 	}
 }
 
+func TestSessionadmit(t *testing.T) {
+	t.Parallel()
+
+	var now = time.Now()
+	var empty = &Request{rid: 10}
+	var payload = &Request{rid: 10, body: Body{Children: []element.Element{element.New("message")}}}
+	var terminate = &Request{rid: 10, body: Body{Type: "terminate"}}
+	var pause = &Request{rid: 10, body: Body{Pause: 30 * time.Second}}
+	var held = func(n int) map[int]*Request {
+		m := make(map[int]*Request)
+		for i := 0; i < n; i++ {
+			m[i] = &Request{rid: i}
+		}
+		return m
+	}
+	var tests = []struct {
+		s    *Session
+		r    *Request
+		err  *TerminateError
+		held int
+		msg  string
+	}{
+		{
+			s:    &Session{held: held(5)},
+			r:    empty,
+			held: 6,
+			msg:  "Should not limit requests if requests was not negotiated",
+		},
+		{
+			s:    &Session{requests: 2, hold: 1, held: held(1)},
+			r:    empty,
+			held: 2,
+			msg:  "Should admit requests up to the negotiated requests",
+		},
+		{
+			s:    &Session{requests: 2, hold: 1, held: held(2)},
+			r:    payload,
+			err:  ErrPolicyViolation,
+			held: 2,
+			msg:  "Should return policy-violation for too many simultaneous requests",
+		},
+		{
+			s:    &Session{requests: 2, hold: 1, held: held(2)},
+			r:    terminate,
+			held: 3,
+			msg:  "Should allow one additional request to terminate the session",
+		},
+		{
+			s:    &Session{requests: 2, hold: 1, held: held(2)},
+			r:    pause,
+			held: 3,
+			msg:  "Should allow one additional request to pause the session",
+		},
+		{
+			s:    &Session{requests: 2, hold: 1, held: held(3)},
+			r:    terminate,
+			err:  ErrPolicyViolation,
+			held: 3,
+			msg:  "Should only allow one additional request to terminate the session",
+		},
+		{
+			s:    &Session{requests: 1, polling: 5 * time.Second, responded: now.Add(-time.Second)},
+			r:    empty,
+			err:  ErrPolicyViolation,
+			held: 0,
+			msg:  "Should return policy-violation for polling too frequently",
+		},
+		{
+			s:    &Session{requests: 1, polling: 5 * time.Second, responded: now.Add(-time.Second)},
+			r:    payload,
+			held: 1,
+			msg:  "Should allow requests with a payload within the polling interval",
+		},
+		{
+			s:    &Session{requests: 1, polling: 5 * time.Second, responded: now.Add(-6 * time.Second)},
+			r:    empty,
+			held: 1,
+			msg:  "Should allow empty requests after the polling interval",
+		},
+		{
+			s:    &Session{requests: 2, hold: 1, polling: 5 * time.Second, responded: now.Add(-time.Second)},
+			r:    empty,
+			held: 1,
+			msg:  "Should not enforce the polling interval for sessions that hold requests",
+		},
+	}
+	for _, test := range tests {
+		err := test.s.admit(test.r, now)
+		if err != test.err {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%v\nGot :%v", test.err, err)
+		}
+		if len(test.s.held) != test.held {
+			t.Error(test.msg)
+			t.Errorf("Held\nWant:%d\nGot :%d", test.held, len(test.s.held))
+		}
+	}
+}
+
+func TestSessionrepeat(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r, orig *Request
+	var repeated bool
+	var err *TerminateError
+	var b = []byte("<body/>")
+
+	// Should not handle requests that have not been processed
+	s = &Session{ack: 10}
+	r = &Request{rid: 11, proceed: make(chan struct{})}
+	repeated, err = s.repeat(r)
+	if repeated || err != nil {
+		t.Error("Should not handle requests that have not been processed")
+	}
+	// Should replay the response from the history
+	s = &Session{ack: 10, history: map[int][]byte{9: b}}
+	r = &Request{rid: 9, proceed: make(chan struct{})}
+	repeated, err = s.repeat(r)
+	if !repeated || err != nil {
+		t.Error("Should handle repeated requests")
+	}
+	if !reflect.DeepEqual(b, r.raw) {
+		t.Error("Should replay the response from the history")
+		t.Errorf("\nWant:%s\nGot :%s", b, r.raw)
+	}
+	// Should close the original request and wait for its response if it is
+	// still held
+	orig = &Request{rid: 9, closed: make(chan struct{})}
+	s = &Session{ack: 10, held: map[int]*Request{9: orig}}
+	r = &Request{rid: 9, proceed: make(chan struct{})}
+	repeated, err = s.repeat(r)
+	if !repeated || err != nil {
+		t.Error("Should handle repeated requests")
+	}
+	select {
+	case <-orig.closed:
+	default:
+		t.Error("Should close the original request")
+	}
+	if len(s.waiting[9]) != 1 || s.waiting[9][0] != r {
+		t.Error("Should wait for the response to the original request")
+	}
+	// Should return item-not-found if the response is not available
+	s = &Session{ack: 10, history: map[int][]byte{9: b}}
+	r = &Request{rid: 7, proceed: make(chan struct{})}
+	repeated, err = s.repeat(r)
+	if !repeated || err != ErrItemNotFound {
+		t.Error("Should return item-not-found if the response is not available")
+		t.Errorf("\nWant:%v\nGot :%v", ErrItemNotFound, err)
+	}
+	// Should wait for the response to a request that has been received but
+	// not yet processed in order
+	s = &Session{ack: 10, requests: 2}
+	r = &Request{rid: 12, proceed: make(chan struct{})}
+	if repeated, err = s.repeat(r); repeated || err != nil {
+		t.Error("Should not handle requests that have not been received")
+	}
+	r = &Request{rid: 12, proceed: make(chan struct{})}
+	repeated, err = s.repeat(r)
+	if !repeated || err != nil || len(s.waiting[12]) != 1 {
+		t.Error("Should wait for the response to a request that has not been processed")
+	}
+	// Should return item-not-found for requests beyond the window
+	s = &Session{ack: 10, requests: 2}
+	r = &Request{rid: 13, proceed: make(chan struct{})}
+	repeated, err = s.repeat(r)
+	if !repeated || err != ErrItemNotFound {
+		t.Error("Should return item-not-found for requests beyond the window")
+		t.Errorf("\nWant:%v\nGot :%v", ErrItemNotFound, err)
+	}
+}
+
+func TestSessionsent(t *testing.T) {
+	t.Parallel()
+
+	var b = []byte("<body/>")
+	var r = &Request{rid: 12}
+	var w = &Request{rid: 12, proceed: make(chan struct{})}
+	var s = &Session{
+		hold:    1,
+		held:    map[int]*Request{12: r, 13: {rid: 13}},
+		history: map[int][]byte{10: b, 11: b},
+		waiting: map[int][]*Request{12: {w}},
+		acks:    true,
+	}
+	s.sent(r, b)
+	if _, ok := s.held[12]; ok || len(s.held) != 1 {
+		t.Error("Should remove the request from the held requests")
+	}
+	if s.responded.IsZero() {
+		t.Error("Should record the time of the response")
+	}
+	if !reflect.DeepEqual(s.history, map[int][]byte{11: b, 12: b}) {
+		t.Error("Should keep the last hold+1 responses in the history")
+		t.Errorf("\nGot :%v", s.history)
+	}
+	if _, ok := s.unacked[12]; !ok || len(s.unacked) != 1 {
+		t.Error("Should record the response as unacknowledged")
+		t.Errorf("\nGot :%v", s.unacked)
+	}
+	if !reflect.DeepEqual(b, w.raw) {
+		t.Error("Should answer requests waiting on the response")
+		t.Errorf("\nWant:%s\nGot :%s", b, w.raw)
+	}
+	if len(s.waiting) != 0 {
+		t.Error("Should remove the waiting requests")
+	}
+
+	// Should keep responses that have not been acknowledged
+	r = &Request{rid: 14}
+	s.sent(r, b)
+	if _, ok := s.history[12]; !ok {
+		t.Error("Should keep responses that have not been acknowledged")
+		t.Errorf("\nGot :%v", s.history)
+	}
+	// Should not record unacknowledged responses if acks are not enabled
+	s = &Session{hold: 1}
+	s.sent(&Request{rid: 12}, b)
+	if len(s.unacked) != 0 {
+		t.Error("Should not record unacknowledged responses if acks are not enabled")
+		t.Errorf("\nGot :%v", s.unacked)
+	}
+}
+
+func TestSessionverify(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r *Request
+	var k0 = "seed"
+	var k1, k2, k3 = hashKey(k0, 1), hashKey(k0, 2), hashKey(k0, 3)
+
+	// Should not verify keys if the session is not using key sequencing
+	s = &Session{}
+	if err := s.verify(&Request{rid: 11}); err != nil {
+		t.Error("Should not verify keys if the session is not using key sequencing")
+	}
+	// Should verify the key and advance the sequence
+	s = &Session{key: k3, keyRID: 10}
+	r = &Request{rid: 11, body: Body{Key: k2}}
+	if err := s.verify(r); err != nil {
+		t.Errorf("Unexpected error verifying key: %s", err)
+	}
+	if s.key != k2 || s.keyRID != 11 {
+		t.Error("Should advance the key sequence")
+	}
+	// Should return item-not-found for a missing key
+	s = &Session{key: k3, keyRID: 10}
+	r = &Request{rid: 11}
+	if err := s.verify(r); err != ErrItemNotFound {
+		t.Error("Should return item-not-found for a missing key")
+	}
+	// Should return item-not-found for an incorrect key
+	s = &Session{key: k3, keyRID: 10}
+	r = &Request{rid: 11, body: Body{Key: k1}}
+	if err := s.verify(r); err != ErrItemNotFound {
+		t.Error("Should return item-not-found for an incorrect key")
+	}
+	// Should not move the sequence back for a late request
+	s = &Session{key: k1, keyRID: 12, keySent: k1}
+	r = &Request{rid: 11, body: Body{Key: k2}}
+	if err := s.verify(r); err != nil {
+		t.Errorf("Unexpected error verifying key: %s", err)
+	}
+	if s.key != k1 || s.keyRID != 12 {
+		t.Error("Should not move the key sequence back for a late request")
+	}
+	// Should replace the key sequence with newkey
+	s = &Session{key: k1, keyRID: 12}
+	r = &Request{rid: 13, body: Body{Key: k0, NewKey: "foo"}}
+	if err := s.verify(r); err != nil {
+		t.Errorf("Unexpected error verifying key: %s", err)
+	}
+	if s.key != "foo" || s.keyRID != 13 {
+		t.Error("Should replace the key sequence with newkey")
+	}
+	// Should accept the key of the original request for a retransmission
+	r = &Request{rid: 13, body: Body{Key: k0, NewKey: "foo"}}
+	if err := s.verify(r); err != nil {
+		t.Errorf("Unexpected error verifying key: %s", err)
+	}
+	if s.key != "foo" || s.keyRID != 13 {
+		t.Error("Should not change the key sequence for a retransmission")
+	}
+	// Should return item-not-found for a retransmission with another key
+	r = &Request{rid: 13, body: Body{Key: k1}}
+	if err := s.verify(r); err != ErrItemNotFound {
+		t.Error("Should return item-not-found for a retransmission with another key")
+	}
+}
+
+func TestSessionProcessKey(t *testing.T) {
+	t.Parallel()
+
+	var k0 = "seed"
+	var k1 = hashKey(k0, 1)
+	var b = []byte("<body/>")
+
+	// Should not replay a response to a request without a valid key
+	s := &Session{
+		key:        k0,
+		keyRID:     12,
+		keySent:    k1,
+		ack:        12,
+		history:    map[int][]byte{12: b},
+		terminator: make(chan termination, 1),
+		exit:       make(chan struct{}),
+	}
+	r := &Request{rid: 12, body: Body{Key: k0}, proceed: make(chan struct{})}
+	if err := s.Process(r); err != ErrInvalidKey {
+		t.Error("Should not replay a response to a request without a valid key")
+		t.Errorf("\nWant:%v\nGot :%v", ErrInvalidKey, err)
+	}
+	if r.raw != nil {
+		t.Error("Should not replay a response to a request without a valid key")
+		t.Errorf("\nGot :%s", r.raw)
+	}
+	select {
+	case <-s.exit:
+		t.Error("Should not terminate the session for a request without a valid key")
+	default:
+	}
+
+	// Should replay a response to a retransmission with the original key
+	r = &Request{rid: 12, body: Body{Key: k1}, proceed: make(chan struct{})}
+	if err := s.Process(r); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(b, r.raw) {
+		t.Error("Should replay a response to a retransmission with the original key")
+		t.Errorf("\nWant:%s\nGot :%s", b, r.raw)
+	}
+}
+
+func TestSessionacknowledge(t *testing.T) {
+	t.Parallel()
+
+	var now = time.Now()
+	var s *Session
+	var r *Request
+
+	// Should remove acknowledged responses
+	s = &Session{acks: true, unacked: map[int]time.Time{10: now, 11: now, 12: now}}
+	r = &Request{body: Body{Ack: 11}}
+	s.acknowledge(r, now)
+	if !reflect.DeepEqual(s.unacked, map[int]time.Time{12: now}) {
+		t.Error("Should remove acknowledged responses")
+		t.Errorf("\nGot :%v", s.unacked)
+	}
+	if r.response.Report != 0 {
+		t.Error("Should not report responses sent recently")
+	}
+	// Should report the lowest response that has not been acknowledged
+	s = &Session{acks: true, unacked: map[int]time.Time{
+		10: now.Add(-5 * time.Second),
+		11: now.Add(-4 * time.Second),
+		12: now,
+	}}
+	r = &Request{body: Body{Ack: 9}}
+	s.acknowledge(r, now)
+	if r.response.Report != 10 {
+		t.Error("Should report the lowest response that has not been acknowledged")
+		t.Errorf("\nWant:%d\nGot :%d", 10, r.response.Report)
+	}
+	if r.response.Time != 5*time.Second {
+		t.Error("Should report the time since the response was sent")
+		t.Errorf("\nWant:%s\nGot :%s", 5*time.Second, r.response.Time)
+	}
+	// Should ignore acks if the client did not enable them
+	s = &Session{unacked: map[int]time.Time{10: now.Add(-5 * time.Second)}}
+	r = &Request{body: Body{Ack: 9}}
+	s.acknowledge(r, now)
+	if r.response.Report != 0 || len(s.unacked) != 1 {
+		t.Error("Should ignore acks if the client did not enable them")
+	}
+}
+
+func TestSessionProcessPause(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r *Request
+	// Should cap the pause at maxpause
+	s = &Session{processor: make(chan *Request, 1), maxpause: 60 * time.Second}
+	r = &Request{rid: 10, body: Body{Pause: 120 * time.Second}}
+	s.Process(r)
+	if r.body.Pause != 60*time.Second {
+		t.Error("Should cap the pause at maxpause")
+		t.Errorf("\nWant:%s\nGot :%s", 60*time.Second, r.body.Pause)
+	}
+	// Should ignore the pause if the session does not allow pausing
+	s = &Session{processor: make(chan *Request, 1)}
+	r = &Request{rid: 10, body: Body{Pause: 120 * time.Second}}
+	s.Process(r)
+	if r.body.Pause != 0 {
+		t.Error("Should ignore the pause if the session does not allow pausing")
+		t.Errorf("\nWant:%s\nGot :%s", time.Duration(0), r.body.Pause)
+	}
+}
+
+func TestSessionpause(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r1, r2 *Request
+	var queue chan *Request
+	var responder chan element.Element
+	var payload []element.Element
+
+	// Should answer held requests and write the remaining payload to the
+	// pausing request
+	responder = make(chan element.Element, 1)
+	queue = make(chan *Request, 1)
+	responder <- element.New("bar")
+	r1 = &Request{proceed: make(chan struct{})}
+	r2 = &Request{proceed: make(chan struct{})}
+	queue <- r1
+	s = &Session{responder: responder}
+	s.pause(r2, queue, []element.Element{element.New("foo")})
+	select {
+	case <-r1.proceed:
+	default:
+		t.Error("Should answer held requests")
+	}
+	if len(r1.payload) != 0 || r1.response.Type != "" {
+		t.Error("Should answer held requests with an empty body")
+		t.Errorf("\nGot :%+v", r1.response)
+	}
+	select {
+	case <-r2.proceed:
+	default:
+		t.Error("Should answer the pausing request")
+	}
+	payload = []element.Element{element.New("foo"), element.New("bar")}
+	if !reflect.DeepEqual(r2.payload, payload) {
+		t.Error("Should flush pending payload to the pausing request")
+		t.Errorf("\nWant:%+v\nGot :%+v", payload, r2.payload)
+	}
+}
+
+func TestSessionfail(t *testing.T) {
+	t.Parallel()
+
+	// Should send a termination with the condition and close the session
+	terminator := make(chan termination, 1)
+	exit := make(chan struct{})
+	s := &Session{terminator: terminator, exit: exit}
+	s.fail(ErrPolicyViolation)
+	select {
+	case term := <-terminator:
+		if term.condition != "policy-violation" || term.r != nil {
+			t.Error("Should send a termination with the condition")
+			t.Errorf("\nGot :%+v", term)
+		}
+	default:
+		t.Error("Should send a termination")
+	}
+	select {
+	case <-exit:
+	default:
+		t.Error("Should close the session")
+	}
+}
+
 func TestSessionClose(t *testing.T) {
 	t.Parallel()
 	var s *Session
@@ -244,24 +711,6 @@ func TestSessionprocess(t *testing.T) {
 		t.Error("Closing exit channel should exit processor goroutine")
 	default:
 	}
-	// Should expire after inactivity period
-	processor = make(chan *Request)
-	inactivity = 1 * time.Nanosecond
-	exit = make(chan struct{})
-	s = &Session{
-		inactivity: inactivity,
-		exit:       exit,
-		processor:  processor,
-	}
-	s.process(queue, buffer)
-	if !s.expired {
-		t.Error("Session should be set to expired after inactivity period")
-	}
-	select {
-	case <-exit:
-	default:
-		t.Error("Session exit channel should be closed after expired inactivity period")
-	}
 	// Should process request
 	processor = make(chan *Request)
 	queue = make(chan *Request, 1)
@@ -394,7 +843,6 @@ func TestSessionprocess(t *testing.T) {
 	}
 	go s.process(queue, buffer)
 	processor <- r
-	close(exit)
 
 	select {
 	case gotEl = <-buffer:
@@ -406,10 +854,9 @@ func TestSessionprocess(t *testing.T) {
 		t.Error("Should pass elements from request down buffer")
 		t.Errorf("\nWant:%+v\nGot :%+v", el, gotEl)
 	}
-	if s.ack != r.rid {
-		t.Error("Should increment ack of the session")
-		t.Errorf("\nWant:%d\nGot :%d", r.rid, s.ack)
-	}
+	// Should increment ack of the session
+	transporttest.Eventually(t, func() bool { return s.Ack() == r.rid })
+	close(exit)
 	// ---> Should process requests in order
 	processor = make(chan *Request)
 	queue = make(chan *Request)
@@ -438,7 +885,6 @@ func TestSessionprocess(t *testing.T) {
 	go s.process(queue, buffer)
 	processor <- r
 	processor <- r2
-	close(exit)
 	select {
 	case gotEl = <-buffer:
 	case <-time.After(2 * time.Second):
@@ -454,11 +900,101 @@ func TestSessionprocess(t *testing.T) {
 		t.Error("Should process requests in order")
 		t.Errorf("\nWant:%+v\nGot :%+v", el, gotEl)
 	}
-	if s.ack != r2.rid {
-		t.Error("Should increment ack of the session")
-		t.Errorf("\nWant:%d\nGot :%d", r.rid, s.ack)
+	// Should increment ack of the session
+	transporttest.Eventually(t, func() bool { return s.Ack() == r2.rid })
+	close(exit)
+	// ---> Should send a pause request to the pauser instead of queueing it
+	processor = make(chan *Request)
+	queue = make(chan *Request, 1)
+	buffer = make(chan element.Element, 1)
+	pauser := make(chan *Request, 1)
+	exit = make(chan struct{})
+	r = &Request{
+		rid:  3984712,
+		body: Body{Pause: 30 * time.Second},
 	}
-
+	s = &Session{
+		inactivity: 10 * time.Second,
+		processor:  processor,
+		pauser:     pauser,
+		exit:       exit,
+		current:    3984712,
+	}
+	go s.process(queue, buffer)
+	processor <- r
+	select {
+	case got = <-pauser:
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for pause")
+	}
+	if got != r {
+		t.Error("Should send the pause request to the pauser")
+		t.Errorf("\nWant:%+v\nGot :%+v", r, got)
+	}
+	if len(queue) != 0 {
+		t.Error("Should not queue a pause request")
+	}
+	close(exit)
+	// ---> Should buffer elements, close the buffer and send a termination
+	//      when a terminate request is processed
+	processor = make(chan *Request)
+	queue = make(chan *Request, 1)
+	buffer = make(chan element.Element, 1)
+	terminator := make(chan termination, 1)
+	inactivity = 10 * time.Second
+	exit = make(chan struct{})
+	el = element.New("presence")
+	r = &Request{
+		rid:     4892734,
+		body:    Body{Type: "terminate", Children: []element.Element{el}},
+		proceed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	s = &Session{
+		inactivity: inactivity,
+		processor:  processor,
+		terminator: terminator,
+		exit:       exit,
+		current:    4892734,
+	}
+	go s.process(queue, buffer)
+	processor <- r
+	var term termination
+	select {
+	case term = <-terminator:
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for termination")
+	}
+	if term.r != r {
+		t.Error("Should send the terminate request to the terminator")
+		t.Errorf("\nWant:%+v\nGot :%+v", r, term.r)
+	}
+	if len(queue) != 0 {
+		t.Error("Should not queue a terminate request")
+	}
+	gotEl = <-buffer
+	if !reflect.DeepEqual(el, gotEl) {
+		t.Error("Should pass elements from terminate request down buffer")
+		t.Errorf("\nWant:%+v\nGot :%+v", el, gotEl)
+	}
+	if _, ok := <-buffer; ok {
+		t.Error("Should close the buffer once the session is terminated")
+	}
+	// ---> Should answer requests received after termination immediately
+	r2 = &Request{
+		rid:     4892735,
+		proceed: make(chan struct{}),
+	}
+	processor <- r2
+	select {
+	case <-r2.proceed:
+	case <-time.After(2 * time.Second):
+		t.Error("Should answer requests received after termination")
+	}
+	if r2.response.Type != "terminate" {
+		t.Error("Requests received after termination should be terminated")
+	}
+	close(exit)
 }
 
 func TestSessionbuffer(t *testing.T) {
@@ -554,6 +1090,44 @@ func TestSessionbuffer(t *testing.T) {
 	// Should exit
 }
 
+func TestSessionbufferClosed(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var el, got element.Element
+	var buffer chan element.Element
+	var elements chan element.Element
+	var exit chan struct{}
+
+	// Should hand out remaining elements and then close the session when the
+	// buffer is closed
+	buffer = make(chan element.Element, 1)
+	elements = make(chan element.Element)
+	exit = make(chan struct{})
+	el = element.New("presence")
+	s = &Session{
+		exit:     exit,
+		elements: elements,
+	}
+	buffer <- el
+	close(buffer)
+	go s.buffer(buffer)
+	select {
+	case got = <-elements:
+	case <-time.After(2 * time.Second):
+		t.Error("Should send remaining elements after the buffer is closed")
+	}
+	if !reflect.DeepEqual(el, got) {
+		t.Error("Element passed into buffer should be read out.")
+		t.Errorf("\nWant:%+v\nGot :%+v", el, got)
+	}
+	select {
+	case <-exit:
+	case <-time.After(2 * time.Second):
+		t.Error("Should close the session once the buffer is drained")
+	}
+}
+
 func TestSessionNewSession(t *testing.T) {
 	t.Parallel()
 
@@ -572,7 +1146,11 @@ func TestSessionNewSession(t *testing.T) {
 	}
 	if s.current != rid {
 		t.Error("Current request ID should be set on Session")
-		t.Errorf("\nWant:%s\nGot :%s", rid, s.current)
+		t.Errorf("\nWant:%d\nGot :%d", rid, s.current)
+	}
+	if s.hold != hold {
+		t.Error("Hold should be set on Session")
+		t.Errorf("\nWant:%d\nGot :%d", hold, s.hold)
 	}
 	if s.wait != wait {
 		t.Error("Wait should be set on Session")
@@ -610,6 +1188,87 @@ func TestSessionNewSession(t *testing.T) {
 	}
 }
 
+func TestSessionNewSessionFromResponse(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r *Request
+	var want, got element.Element
+	var sid string = "bo928391289sh"
+	var rid, hold, requests int = 12789247982, 8, 9
+	var wait, inactivity, polling time.Duration = 16 * time.Second, 300 * time.Second, 3 * time.Second
+	var maxpause time.Duration = 120 * time.Second
+
+	// Should be able to construct new Session
+	s = NewSessionFromResponse(rid, Body{
+		SID:        sid,
+		Hold:       hold,
+		Requests:   requests,
+		Wait:       wait,
+		Inactivity: inactivity,
+		Polling:    polling,
+		MaxPause:   maxpause,
+	})
+	if s.sid != sid {
+		t.Error("Session ID should be set on Session")
+		t.Errorf("\nWant:%s\nGot :%s", sid, s.sid)
+	}
+	if s.current != rid {
+		t.Error("Current request ID should be set on Session")
+		t.Errorf("\nWant:%d\nGot :%d", rid, s.current)
+	}
+	if s.wait != wait {
+		t.Error("Wait should be set on Session")
+		t.Errorf("\nWant:%s\nGot :%s", wait, s.wait)
+	}
+	if s.inactivity != inactivity {
+		t.Error("Inactivity should be set on Session")
+		t.Errorf("\nWant:%s\nGot :%s", inactivity, s.inactivity)
+	}
+	if s.hold != hold {
+		t.Error("Hold should be set on Session")
+		t.Errorf("\nWant:%d\nGot :%d", hold, s.hold)
+	}
+	if s.requests != requests {
+		t.Error("Requests should be set on Session")
+		t.Errorf("\nWant:%d\nGot :%d", requests, s.requests)
+	}
+	if s.polling != polling {
+		t.Error("Polling should be set on Session")
+		t.Errorf("\nWant:%s\nGot :%s", polling, s.polling)
+	}
+	if s.maxpause != maxpause {
+		t.Error("MaxPause should be set on Session")
+		t.Errorf("\nWant:%s\nGot :%s", maxpause, s.maxpause)
+	}
+	// Goroutines should be running
+	want = element.New("foo")
+	r = &Request{
+		rid:     12789247982,
+		body:    Body{Children: []element.Element{want}},
+		proceed: make(chan struct{}),
+	}
+	select {
+	case s.processor <- r:
+	case <-time.After(2 * time.Second):
+		t.Error("process goroutine is not running")
+	}
+	select {
+	case got = <-s.elements:
+	case <-time.After(2 * time.Second):
+		t.Error("buffer goroutine is not running")
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Error("Recieved an unexpected element")
+		t.Errorf("\nWant:%+v\nGot :%+v", want, got)
+	}
+	select {
+	case s.responder <- got:
+	case <-time.After(2 * time.Second):
+		t.Error("response goroutine is not running")
+	}
+}
+
 func TestSessionresponse(t *testing.T) {
 	t.Parallel()
 
@@ -705,3 +1364,275 @@ func TestSessionresponse(t *testing.T) {
 		t.Errorf("\nGot :%+v\nWant:%+v", r2.payload, payload)
 	}
 }
+
+func TestSessionterminate(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r1, r2 *Request
+	var queue chan *Request
+	var responder chan element.Element
+	var payload []element.Element
+
+	// Should answer held requests with terminate and write the remaining
+	// payload to the terminating request
+	responder = make(chan element.Element, 1)
+	queue = make(chan *Request, 1)
+	responder <- element.New("bar")
+	r1 = &Request{proceed: make(chan struct{})}
+	r2 = &Request{proceed: make(chan struct{})}
+	queue <- r1
+	s = &Session{responder: responder}
+	s.terminate(termination{r: r2, condition: "system-shutdown"}, queue, []element.Element{element.New("foo")})
+	select {
+	case <-r1.proceed:
+	default:
+		t.Error("Should answer held requests")
+	}
+	if r1.response.Type != "terminate" || r1.response.Condition != "system-shutdown" {
+		t.Error("Should answer held requests with a terminate body")
+		t.Errorf("\nGot :%+v", r1.response)
+	}
+	if len(r1.payload) != 0 {
+		t.Error("Should not write payload to held requests")
+	}
+	select {
+	case <-r2.proceed:
+	default:
+		t.Error("Should answer the terminating request")
+	}
+	payload = []element.Element{element.New("foo"), element.New("bar")}
+	if !reflect.DeepEqual(r2.payload, payload) {
+		t.Error("Should flush pending payload to the terminating request")
+		t.Errorf("\nWant:%+v\nGot :%+v", payload, r2.payload)
+	}
+	if r2.response.Type != "terminate" || r2.response.Condition != "system-shutdown" {
+		t.Error("Should answer the terminating request with a terminate body")
+		t.Errorf("\nGot :%+v", r2.response)
+	}
+}
+
+func TestSessionresponseAccumulate(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var r *Request
+	var queue chan *Request
+	var responder chan element.Element
+	var exit chan struct{}
+	var payload []element.Element
+
+	// Should keep accepting elements while waiting for a request
+	responder = make(chan element.Element)
+	queue = make(chan *Request)
+	exit = make(chan struct{})
+	s = &Session{exit: exit, responder: responder}
+	go s.response(queue)
+	for _, name := range []string{"foo", "bar"} {
+		select {
+		case responder <- element.New(name):
+		case <-time.After(2 * time.Second):
+			t.Fatal("Should accept elements while waiting for a request")
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+	r = &Request{proceed: make(chan struct{})}
+	queue <- r
+	select {
+	case <-r.proceed:
+	case <-time.After(2 * time.Second):
+		t.Error("Should write the accumulated elements to the next request")
+	}
+	payload = []element.Element{element.New("foo"), element.New("bar")}
+	if !reflect.DeepEqual(r.payload, payload) {
+		t.Error("Should write the accumulated elements to the next request")
+		t.Errorf("\nWant:%+v\nGot :%+v", payload, r.payload)
+	}
+	close(exit)
+}
+
+func TestSessionfailed(t *testing.T) {
+	t.Parallel()
+
+	// Should replace the recorded response with an empty body and requeue the
+	// payload
+	s := &Session{
+		requeue: make(chan []element.Element, 1),
+		exit:    make(chan struct{}),
+		history: map[int][]byte{10: []byte("<body><foo/></body>")},
+		unacked: map[int]time.Time{10: time.Now()},
+	}
+	r := &Request{rid: 10, response: Body{Ack: 10}, payload: []element.Element{element.New("foo")}}
+	s.failed(r)
+	want := Body{Ack: 10}.TransformElement().WriteBytes()
+	if !reflect.DeepEqual(s.history[10], want) {
+		t.Error("Should replace the recorded response with an empty body")
+		t.Errorf("\nWant:%s\nGot :%s", want, s.history[10])
+	}
+	if _, ok := s.unacked[10]; ok {
+		t.Error("Should not report the failed response as missing")
+	}
+	select {
+	case els := <-s.requeue:
+		if !reflect.DeepEqual(els, r.payload) {
+			t.Error("Should requeue the payload")
+			t.Errorf("\nWant:%+v\nGot :%+v", r.payload, els)
+		}
+	default:
+		t.Error("Should requeue the payload")
+	}
+
+	// Should not requeue the payload of a terminate response
+	r = &Request{rid: 11, response: Body{Type: "terminate"}, payload: []element.Element{element.New("foo")}}
+	s.failed(r)
+	select {
+	case <-s.requeue:
+		t.Error("Should not requeue the payload of a terminate response")
+	default:
+	}
+}
+
+func TestSessionresponseRequeue(t *testing.T) {
+	t.Parallel()
+
+	// Should write a requeued payload before later elements
+	responder := make(chan element.Element, 1)
+	requeue := make(chan []element.Element)
+	queue := make(chan *Request, 1)
+	exit := make(chan struct{})
+	defer close(exit)
+	s := &Session{exit: exit, responder: responder, requeue: requeue}
+	go s.response(queue)
+	requeue <- []element.Element{element.New("foo")}
+	responder <- element.New("bar")
+	r := &Request{proceed: make(chan struct{})}
+	queue <- r
+	select {
+	case <-r.proceed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should write a requeued payload to the next request")
+	}
+	if len(r.payload) == 0 || !reflect.DeepEqual(r.payload[0], element.New("foo")) {
+		t.Error("Should write a requeued payload before later elements")
+		t.Errorf("\nGot :%+v", r.payload)
+	}
+}
+
+func TestSessioncheckRestart(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		restartable bool
+		children    []element.Element
+		err         error
+		msg         string
+	}{
+		{true, nil, nil, "Should accept a restart after authentication"},
+		{false, nil, ErrBadRequest, "Should reject a restart before authentication"},
+		{true, []element.Element{element.New("message")}, ErrBadRequest,
+			"Should reject a restart with a payload"},
+	}
+	for _, test := range tests {
+		s := &Session{restartable: test.restartable}
+		r := &Request{rid: 10, body: Body{Restart: true, Children: test.children}}
+		err := s.checkRestart(r, nil)
+		if (err == nil) != (test.err == nil) {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%v\nGot :%v", test.err, err)
+		}
+	}
+
+	// Should only allow one restart per authentication
+	s := &Session{restartable: true}
+	r := &Request{rid: 10, body: Body{Restart: true}}
+	s.checkRestart(r, nil)
+	if err := s.checkRestart(r, nil); err != ErrBadRequest {
+		t.Error("Should only allow one restart per authentication")
+	}
+
+	// Should track authentication for each stream
+	st := &Stream{restartable: true}
+	s = &Session{}
+	if err := s.checkRestart(r, st); err != nil {
+		t.Error("Should track authentication for each stream")
+		t.Errorf("\nGot :%v", err)
+	}
+}
+
+func TestSessionWriteAuthenticated(t *testing.T) {
+	t.Parallel()
+
+	// Should allow a restart once SASL success has been written
+	s := &Session{responder: make(chan element.Element, 2), exit: make(chan struct{})}
+	s.Write(element.New("message"))
+	if s.restartable {
+		t.Error("Should not allow a restart before SASL success")
+	}
+	s.Write(element.New("success").AddAttr("xmlns", namespace.SASL))
+	if !s.restartable {
+		t.Error("Should allow a restart once SASL success has been written")
+	}
+}
+
+func TestSessionidle(t *testing.T) {
+	t.Parallel()
+
+	var s *Session
+	var exit chan struct{}
+
+	// Should expire after inactivity period
+	exit = make(chan struct{})
+	s = &Session{inactivity: time.Millisecond, exit: exit}
+	s.lock.Lock()
+	s.idle(time.Now())
+	s.lock.Unlock()
+	select {
+	case <-exit:
+	case <-time.After(2 * time.Second):
+		t.Error("Session exit channel should be closed after expired inactivity period")
+	}
+	if !s.Expired() {
+		t.Error("Session should be set to expired after inactivity period")
+	}
+
+	// Should not expire while a request is held
+	exit = make(chan struct{})
+	s = &Session{inactivity: time.Millisecond, exit: exit}
+	s.lock.Lock()
+	s.idle(time.Now())
+	s.lock.Unlock()
+	r := &Request{rid: 1}
+	if err := s.admit(r, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !s.Expiry().IsZero() {
+		t.Error("Should not have an expiry while a request is held")
+	}
+	select {
+	case <-exit:
+		t.Error("Should not expire while a request is held")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Should start the inactivity period once no requests are held
+	now := time.Now()
+	s.inactivity = 10 * time.Second
+	s.sent(r, nil)
+	if s.Expiry().Before(now.Add(10 * time.Second)) {
+		t.Error("Should start the inactivity period once no requests are held")
+		t.Errorf("\nGot :%s", s.Expiry())
+	}
+	s.Close()
+
+	// Should extend the inactivity period by the pause
+	s = &Session{inactivity: 10 * time.Second, exit: make(chan struct{})}
+	defer s.Close()
+	r = &Request{rid: 1, body: Body{Pause: time.Minute}}
+	s.admit(r, time.Now())
+	now = time.Now()
+	s.sent(r, nil)
+	if s.Expiry().Before(now.Add(time.Minute)) {
+		t.Error("Should extend the inactivity period by the pause")
+		t.Errorf("\nGot :%s", s.Expiry())
+	}
+}
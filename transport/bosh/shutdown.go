@@ -0,0 +1,87 @@
+package bosh
+
+import (
+	"context"
+	"log"
+)
+
+// ShutdownURI sets the URI clients are sent to when the handler shuts down.
+// If it is set sessions are terminated with see-other-uri instead of
+// system-shutdown, so clients can reconnect to another node.
+func (h *Handler) ShutdownURI(uri string) *Handler {
+	h.shutdownURI = uri
+	return h
+}
+
+// Shutdown stops the handler from creating new sessions and terminates every
+// session it has created. Held requests are answered with system-shutdown, or
+// see-other-uri if a ShutdownURI has been set, and each session is closed,
+// which closes the streams using it. Shutdown returns once the goroutines of
+// every session have exited or ctx is done, in which case the context's error
+// is returned. The goroutines running the streams of the sessions are not
+// waited for.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.lock.Lock()
+	h.closing = true
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.lock.Unlock()
+
+	log.Printf("Shutting down %d sessions", len(sessions))
+	err := h.shutdownError()
+	for _, s := range sessions {
+		// Terminating a session waits for its goroutines to answer the held
+		// requests, which may take longer than ctx allows.
+		go func(s *Session) {
+			s.Terminate(err)
+			h.r.Remove(s.SID())
+		}(s)
+	}
+	for _, s := range sessions {
+		select {
+		case <-s.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// shutdownError returns the condition sessions are terminated with when the
+// handler shuts down.
+func (h *Handler) shutdownError() *TerminateError {
+	if h.shutdownURI != "" {
+		return SeeOtherURI(h.shutdownURI)
+	}
+	return ErrSystemShutdown
+}
+
+// shuttingDown returns true once the handler has started shutting down.
+func (h *Handler) shuttingDown() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.closing
+}
+
+// track records a session created by the handler until the session's
+// goroutines have exited. It returns false if the handler is shutting down.
+func (h *Handler) track(s *Session) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closing {
+		return false
+	}
+	if h.sessions == nil {
+		h.sessions = make(map[string]*Session)
+	}
+	h.sessions[s.SID()] = s
+	go func() {
+		<-s.Done()
+		h.lock.Lock()
+		delete(h.sessions, s.SID())
+		h.lock.Unlock()
+	}()
+	return true
+}
@@ -0,0 +1,134 @@
+package bosh
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/element"
+)
+
+func TestHandlerShutdown(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		uri       string
+		condition string
+		msg       string
+	}{
+		{"", "system-shutdown", "Should terminate held requests with system-shutdown"},
+		{"https://other.example.com/bosh", "see-other-uri", "Should send clients to the shutdown URI"},
+	}
+	for _, test := range tests {
+		reg := new(mapRegister)
+		h := NewHandler(reg, BodyTransformer{}, Body{}, "localhost").ShutdownURI(test.uri)
+		s := NewSessionFromResponse(1, Body{SID: "foobar", Hold: 1, HoldSet: true, Requests: 2,
+			Wait: 5 * time.Second, Inactivity: 10 * time.Second})
+		h.track(s)
+		reg.Add("foobar", s)
+		r := NewRequest(1, 5*time.Second, "foobar", Body{RID: 1}, Body{}, s.UnregisterRequest())
+		if err := s.Process(r); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		transporttest.Eventually(t, func() bool { return len(s.queue) != 0 })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := h.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Error("Should wait for the sessions to exit")
+			t.Errorf("\nGot :%s", err)
+		}
+		select {
+		case <-r.proceed:
+		default:
+			t.Fatal(test.msg)
+		}
+		if r.response.Type != "terminate" || r.response.Condition != test.condition {
+			t.Error(test.msg)
+			t.Errorf("\nGot :%+v", r.response)
+		}
+		if _, err := reg.Lookup("foobar"); err != ErrSessionNotFound {
+			t.Error("Should remove the sessions from the register")
+		}
+
+		// Should not create sessions once shut down
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", strings.NewReader(
+			`<body rid='1' ver='1.6' xmlns='http://jabber.org/protocol/httpbind'/>`))
+		h.ServeHTTP(rec, req)
+		want := h.shutdownError().TransformElement().WriteBytes()
+		if !reflect.DeepEqual(want, rec.Body.Bytes()) {
+			t.Error("Should not create sessions once shut down")
+			t.Errorf("\nWant:%s\nGot :%s", want, rec.Body.Bytes())
+		}
+	}
+}
+
+func TestHandlerShutdownContext(t *testing.T) {
+	t.Parallel()
+
+	// Should return once ctx is done even if a session cannot be terminated
+	h := NewHandler(new(mapRegister), BodyTransformer{}, Body{}, "localhost")
+	s := &Session{sid: "foobar", terminator: make(chan termination),
+		exit: make(chan struct{}), done: make(chan struct{})}
+	defer close(s.exit)
+	h.track(s)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- h.Shutdown(ctx) }()
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Error("Should return the context's error")
+			t.Errorf("\nWant:%s\nGot :%v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Should return once ctx is done even if a session cannot be terminated")
+	}
+}
+
+func TestSessionDone(t *testing.T) {
+	t.Parallel()
+
+	// Should close done once the session's goroutines have exited
+	s := NewSessionFromResponse(1, Body{SID: "foobar", Wait: time.Second, Inactivity: 10 * time.Second})
+	s.AddStream("example.com")
+	s.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Error("Should close done once the session's goroutines have exited")
+	}
+
+	// Should not add streams once the session is closed
+	if st := s.AddStream("example.com"); st != nil {
+		t.Error("Should not add streams once the session is closed")
+	}
+}
+
+func TestSessionprocessExit(t *testing.T) {
+	t.Parallel()
+
+	// Should stop processing once the session is closed, even if nothing is
+	// reading its elements
+	s := &Session{processor: make(chan *Request), exit: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.process(make(chan *Request, 1), make(chan element.Element))
+		close(done)
+	}()
+	s.processor <- &Request{rid: 0, body: Body{Children: []element.Element{element.New("foo")}},
+		proceed: make(chan struct{}), closed: make(chan struct{})}
+	close(s.exit)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Should stop processing once the session is closed")
+	}
+}
@@ -0,0 +1,128 @@
+package bosh
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/stream"
+)
+
+// A Stream is an additional XMPP stream within a Session, as described in
+// http://xmpp.org/extensions/xep-0124.html#multi
+//
+// The first stream of a session is handled by the Session itself. Each Stream
+// has its own elements and restarts, but shares the requests of the Session
+// with the other streams.
+type Stream struct {
+	name string
+	to   string
+	s    *Session
+
+	// buffer receives the elements from the session's requests in order.
+	buffer    chan element.Element
+	elements  chan element.Element
+	responder chan element.Element
+	restart   chan struct{}
+	requeue   chan []element.Element
+
+	// restartable is true once the client has authenticated on this stream
+	// and until it restarts the stream. It is guarded by the session's lock.
+	restartable bool
+
+	exit chan struct{}
+	lock sync.Mutex
+}
+
+// newStream creates a stream for the session s. The stream's goroutines are
+// started by run.
+func newStream(s *Session, name, to string) *Stream {
+	st := new(Stream)
+	st.name = name
+	st.to = to
+	st.s = s
+	st.buffer = make(chan element.Element)
+	st.elements = make(chan element.Element)
+	st.responder = make(chan element.Element)
+	st.restart = make(chan struct{}, 1)
+	st.requeue = make(chan []element.Element)
+	st.exit = make(chan struct{})
+	return st
+}
+
+// run starts the goroutines of the stream. The caller must have added them to
+// the session's wait group.
+func (st *Stream) run() {
+	s := st.s
+	go func() {
+		defer s.wg.Done()
+		bufferElements(st.buffer, st.elements, st.exit, func() { st.Close() })
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.respond(s.queue, st.name, st.responder, st.requeue, st.exit, false)
+	}()
+}
+
+// Name returns the name of the stream, this is the value of the stream
+// attribute on requests and responses for this stream.
+func (st *Stream) Name() string {
+	return st.name
+}
+
+// To returns the domain the client requested when adding the stream.
+func (st *Stream) To() string {
+	return st.to
+}
+
+// Write writes an element to the stream. See Session.Write.
+func (st *Stream) Write(el element.Element) (err error) {
+	select {
+	case <-st.exit:
+		err = stream.ErrStreamClosed
+	case st.responder <- el:
+		if authenticated(el) {
+			st.s.lock.Lock()
+			st.restartable = true
+			st.s.lock.Unlock()
+		}
+	}
+	return
+}
+
+// Element returns the next element from the stream. See Session.Element.
+func (st *Stream) Element() (el element.Element, err error) {
+	select {
+	case <-st.exit:
+		err = stream.ErrStreamClosed
+	case el = <-st.elements:
+	case <-st.restart:
+		err = stream.ErrRequireRestart
+	}
+	return
+}
+
+// Close implements io.Closer. The stream is removed from its session, the
+// session and its other streams are unaffected.
+func (st *Stream) Close() error {
+	if err := st.close(); err != nil {
+		return err
+	}
+	st.s.lock.Lock()
+	delete(st.s.streams, st.name)
+	st.s.lock.Unlock()
+	return nil
+}
+
+// close closes the exit channel of the stream.
+func (st *Stream) close() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	select {
+	case <-st.exit:
+		return errors.New("Already closed")
+	default:
+	}
+	close(st.exit)
+	return nil
+}
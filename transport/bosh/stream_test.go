@@ -0,0 +1,196 @@
+package bosh
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/stream"
+)
+
+func newStreamSession() *Session {
+	return NewSessionFromResponse(2, Body{
+		SID: "foobar", Stream: "first", Hold: 1, HoldSet: true, Requests: 2,
+		Wait: 2 * time.Second, Inactivity: 10 * time.Second,
+	})
+}
+
+func TestStreamElement(t *testing.T) {
+	t.Parallel()
+
+	// Should route elements to the stream named by the request
+	s := newStreamSession()
+	defer s.Close()
+	st := s.AddStream("example.com")
+	r := NewRequest(2, time.Second, "foobar", Body{SID: "foobar", RID: 2,
+		Stream: st.Name(), Children: []element.Element{element.New("foo")}},
+		Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	done := make(chan element.Element)
+	go func() {
+		el, _ := st.Element()
+		done <- el
+	}()
+	select {
+	case el := <-done:
+		if !reflect.DeepEqual(el, element.New("foo")) {
+			t.Error("Should route elements to the stream named by the request")
+			t.Errorf("\nWant:%s\nGot :%s", element.New("foo"), el)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Should route elements to the stream named by the request")
+	}
+}
+
+func TestSessionProcessAddStream(t *testing.T) {
+	t.Parallel()
+
+	// Should create the stream named by the response
+	s := newStreamSession()
+	defer s.Close()
+	b := Body{SID: "foobar", RID: 2, To: "example.com"}
+	r := NewRequest(2, time.Second, "foobar", b, Body{Stream: "second"}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if st := r.Stream(); st == nil || st.Name() != "second" || st.To() != "example.com" {
+		t.Error("Should create the stream named by the response")
+		t.Errorf("\nGot :%v", st)
+	}
+	done := make(chan struct{})
+	go func() {
+		r.Handle(httptest.NewRecorder())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should answer the request that added the stream")
+	}
+
+	// Should not create another stream for a repeated request
+	r = NewRequest(2, time.Second, "foobar", b, Body{Stream: "third"}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.Stream() != nil {
+		t.Error("Should not create another stream for a repeated request")
+	}
+	if _, ok := s.lookup("third"); ok {
+		t.Error("Should not create another stream for a repeated request")
+	}
+}
+
+func TestStreamWrite(t *testing.T) {
+	t.Parallel()
+
+	// Should label the response with the name of the stream
+	s := newStreamSession()
+	defer s.Close()
+	st := s.AddStream("example.com")
+	r := NewRequest(2, time.Second, "foobar", Body{SID: "foobar", RID: 2},
+		Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := st.Write(element.New("foo")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case <-r.proceed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should write to a held request")
+	}
+	if r.response.Stream != st.Name() {
+		t.Error("Should label the response with the name of the stream")
+		t.Errorf("\nWant:%s\nGot :%s", st.Name(), r.response.Stream)
+	}
+}
+
+func TestStreamTerminate(t *testing.T) {
+	t.Parallel()
+
+	// Should close only the terminated stream
+	s := newStreamSession()
+	defer s.Close()
+	st := s.AddStream("example.com")
+	r := NewRequest(2, time.Second, "foobar", Body{SID: "foobar", RID: 2,
+		Stream: st.Name(), Type: "terminate"}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	select {
+	case <-r.proceed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should answer the terminate request")
+	}
+	if r.response.Type != "" || r.response.Stream != st.Name() {
+		t.Error("Should answer the terminate request for the stream")
+		t.Errorf("\nGot :%+v", r.response)
+	}
+	if _, err := st.Element(); err != stream.ErrStreamClosed {
+		t.Error("Should close the terminated stream")
+		t.Errorf("\nWant:%s\nGot :%v", stream.ErrStreamClosed, err)
+	}
+	if _, ok := s.lookup(st.Name()); ok {
+		t.Error("Should remove the terminated stream from the session")
+	}
+	select {
+	case <-s.exit:
+		t.Error("Should not close the session")
+	default:
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	t.Parallel()
+
+	// Should close the streams when the session is closed
+	s := newStreamSession()
+	st := s.AddStream("example.com")
+	s.Close()
+	if err := st.Write(element.New("foo")); err != stream.ErrStreamClosed {
+		t.Error("Should close the streams when the session is closed")
+		t.Errorf("\nWant:%s\nGot :%v", stream.ErrStreamClosed, err)
+	}
+}
+
+func TestSessionProcessUnknownStream(t *testing.T) {
+	t.Parallel()
+
+	// Should return item-not-found for an unknown stream
+	s := newStreamSession()
+	r := NewRequest(2, time.Second, "foobar", Body{SID: "foobar", RID: 2,
+		Stream: "unknown"}, Body{}, s.UnregisterRequest())
+	if err := s.Process(r); err != ErrItemNotFound {
+		t.Error("Should return item-not-found for an unknown stream")
+		t.Errorf("\nWant:%s\nGot :%v", ErrItemNotFound, err)
+	}
+}
+
+func TestSessionadding(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		stream string
+		b      Body
+		want   bool
+	}{
+		{"add", "first", Body{SID: "foo", To: "example.com"}, true},
+		{"no streams", "", Body{SID: "foo", To: "example.com"}, false},
+		{"no to", "first", Body{SID: "foo"}, false},
+		{"named stream", "first", Body{SID: "foo", To: "example.com", Stream: "first"}, false},
+		{"restart", "first", Body{SID: "foo", To: "example.com", Restart: true}, false},
+	}
+	for _, tc := range testCases {
+		s := &Session{stream: tc.stream}
+		if got := s.adding(tc.b); got != tc.want {
+			t.Errorf("%s: Want %t, Got %t", tc.name, tc.want, got)
+		}
+	}
+}
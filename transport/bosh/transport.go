@@ -4,11 +4,24 @@ import (
 	"errors"
 	"log"
 
+	"github.com/skriptble/gabble/transport/internal/xmpp"
 	"github.com/skriptble/nine/element"
 	"github.com/skriptble/nine/element/stanza"
 	"github.com/skriptble/nine/stream"
 )
 
+// ErrRestartExpected is the error returned from Start when the client sends an
+// element instead of restarting the stream.
+var ErrRestartExpected = errors.New("bosh: expected a stream restart")
+
+// conn is the stream a Transport reads from and writes to. It is implemented
+// by both Session and Stream.
+type conn interface {
+	Write(el element.Element) error
+	Element() (element.Element, error)
+	Close() error
+}
+
 // Transport implements a stream.Transport for BOSH. It handles a bulk of the
 // state associated including holding onto the response writers and handling
 // the timeouts associated with them.
@@ -19,7 +32,9 @@ type Transport struct {
 	// method
 	restart bool
 
-	s *Session
+	s conn
+	// c is the client of an initiating transport.
+	c *Client
 }
 
 func NewTransport(mode stream.Mode, s *Session) stream.Transport {
@@ -29,6 +44,25 @@ func NewTransport(mode stream.Mode, s *Session) stream.Transport {
 	return t
 }
 
+// NewStreamTransport creates a Transport for one of the additional streams of
+// a Session.
+func NewStreamTransport(mode stream.Mode, st *Stream) stream.Transport {
+	t := new(Transport)
+	t.mode = mode
+	t.s = st
+	return t
+}
+
+// NewClientTransport creates an initiating Transport that uses c to connect
+// to a connection manager. The session is created when the stream is started.
+func NewClientTransport(c *Client) stream.Transport {
+	t := new(Transport)
+	t.mode = stream.Initiating
+	t.s = c
+	t.c = c
+	return t
+}
+
 // Close implements io.Closer
 func (t *Transport) Close() error {
 	t.s.Close()
@@ -53,7 +87,7 @@ func (t *Transport) WriteStanza(st stanza.Stanza) error {
 }
 
 // Next retrieves the next element from the underlying Session. This method is
-// a very thin wrapper around the Session's Element method.
+// a very thin wrapper around the Session's or Stream's Element method.
 func (t *Transport) Next() (el element.Element, err error) {
 	// TODO: This should probably catch an ErrSessionClosed and transform it
 	// into an io.EOF or ErrStreamClosed error.
@@ -63,7 +97,7 @@ func (t *Transport) Next() (el element.Element, err error) {
 // Start starts or restarts the stream.
 func (t *Transport) Start(p stream.Properties) (stream.Properties, error) {
 	if t.mode == stream.Initiating {
-		return p, errors.New("Not implemented")
+		return t.initiate(p)
 	}
 
 	// Receiving mode
@@ -71,16 +105,27 @@ func (t *Transport) Start(p stream.Properties) (stream.Properties, error) {
 		return p, stream.ErrDomainNotSet
 	}
 	if t.restart {
-		// Wait for the restart from the client
-		_, err := t.s.Element()
-		if err != stream.ErrRequireRestart {
+		// Wait for the restart from the client. The session only accepts a
+		// restart that follows authentication and carries no payload, so
+		// anything else means the stream cannot continue.
+		el, err := t.s.Element()
+		switch err {
+		case stream.ErrRequireRestart:
+		case nil:
+			log.Printf("Recieved element instead of restart: %s", el)
+			return p, ErrRestartExpected
+		default:
 			log.Printf("Recieved non Restart error: %s", err)
+			return p, err
 		}
 	} else {
 		t.restart = true
 	}
 	log.Println("Sending features")
-	ftrs := element.StreamFeatures
+	// The features are built for each start so the features of a previous
+	// stream are never sent. The stream prefix is declared by the body the
+	// features are sent in.
+	ftrs := element.New("stream:features")
 	for _, f := range p.Features {
 		ftrs = ftrs.AddChild(f)
 	}
@@ -88,3 +133,30 @@ func (t *Transport) Start(p stream.Properties) (stream.Properties, error) {
 	log.Println("Features sent")
 	return p, err
 }
+
+// initiate starts or restarts the stream of an initiating transport. The
+// session is created on the first start and the stream is restarted on the
+// following starts. The features sent by the connection manager are returned
+// in the properties.
+func (t *Transport) initiate(p stream.Properties) (stream.Properties, error) {
+	if t.c == nil {
+		return p, errors.New("bosh: initiating transport without a client")
+	}
+	if t.restart {
+		t.c.Restart()
+	} else {
+		if p.Domain == "" {
+			return p, stream.ErrDomainNotSet
+		}
+		if err := t.c.Open(p.Domain); err != nil {
+			return p, err
+		}
+		t.restart = true
+	}
+	el, err := t.c.Element()
+	if err != nil {
+		return p, err
+	}
+	p.Features, err = xmpp.Features(el)
+	return p, err
+}
@@ -0,0 +1,57 @@
+package bosh
+
+import (
+	"testing"
+
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/stream"
+)
+
+// fakeConn is a conn that returns the given element and error from Element
+// and records the elements written to it.
+type fakeConn struct {
+	el      element.Element
+	err     error
+	written []element.Element
+}
+
+func (c *fakeConn) Write(el element.Element) error {
+	c.written = append(c.written, el)
+	return nil
+}
+
+func (c *fakeConn) Element() (element.Element, error) { return c.el, c.err }
+func (c *fakeConn) Close() error                      { return nil }
+
+func TestTransportStart(t *testing.T) {
+	t.Parallel()
+
+	p := stream.Properties{Domain: "localhost"}
+
+	// Should send fresh features after a restart
+	c := &fakeConn{err: stream.ErrRequireRestart}
+	tp := &Transport{mode: stream.Receiving, restart: true, s: c}
+	if _, err := tp.Start(p); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.written) != 1 || c.written[0].Tag != "features" || len(c.written[0].Child) != 0 {
+		t.Error("Should send fresh features after a restart")
+		t.Errorf("\nGot :%+v", c.written)
+	}
+
+	// Should return ErrRestartExpected if the client sends an element
+	c = &fakeConn{el: element.New("message")}
+	tp = &Transport{mode: stream.Receiving, restart: true, s: c}
+	if _, err := tp.Start(p); err != ErrRestartExpected {
+		t.Error("Should return ErrRestartExpected if the client sends an element")
+		t.Errorf("\nWant:%s\nGot :%v", ErrRestartExpected, err)
+	}
+
+	// Should return the error if the stream is closed
+	c = &fakeConn{err: stream.ErrStreamClosed}
+	tp = &Transport{mode: stream.Receiving, restart: true, s: c}
+	if _, err := tp.Start(p); err != stream.ErrStreamClosed {
+		t.Error("Should return the error if the stream is closed")
+		t.Errorf("\nWant:%s\nGot :%v", stream.ErrStreamClosed, err)
+	}
+}
@@ -0,0 +1,94 @@
+// Package transporttest provides helpers for testing the transports.
+package transporttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
+	"github.com/skriptble/nine/stream"
+)
+
+// EchoStream is a stream factory that writes back every element it receives.
+// The stream offers a mechanisms feature and is restarted after it echoes a
+// SASL success.
+func EchoStream(tp stream.Transport, domain string) {
+	go func() {
+		p := stream.Properties{Domain: domain, Features: []element.Element{element.New("mechanisms")}}
+		p, err := tp.Start(p)
+		if err != nil {
+			return
+		}
+		for {
+			el, err := tp.Next()
+			if err != nil {
+				return
+			}
+			if err := tp.WriteElement(el); err != nil {
+				return
+			}
+			if el.Tag == "success" && el.SelectAttrValue("xmlns", "") == namespace.SASL {
+				if p, err = tp.Start(p); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// EchoClient runs the initiating side of a stream over tp with a server that
+// runs EchoStream for domain. It opens the stream, exchanges a message,
+// authenticates and restarts the stream. The properties of the opened and of
+// the restarted stream are returned so the caller can check what is specific
+// to its transport.
+func EchoClient(t testing.TB, tp stream.Transport, domain string) (opened, restarted stream.Properties) {
+	t.Helper()
+
+	// Should open the stream and return the features
+	opened, err := tp.Start(stream.Properties{Domain: domain})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(opened.Features) != 1 || opened.Features[0].Tag != "mechanisms" {
+		t.Error("Should open the stream and return the features")
+		t.Errorf("\nGot :%v", opened.Features)
+	}
+
+	// Should send and receive elements
+	if err := tp.WriteElement(element.New("message").AddAttr("id", "1")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	el, err := tp.Next()
+	if err != nil || el.Tag != "message" || el.SelectAttrValue("id", "") != "1" {
+		t.Error("Should send and receive elements")
+		t.Errorf("\nGot :%s %v", el, err)
+	}
+
+	// Should restart the stream after authenticating
+	success := element.New("success").AddAttr("xmlns", namespace.SASL)
+	if err := tp.WriteElement(success); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if el, err = tp.Next(); err != nil || el.Tag != "success" {
+		t.Fatalf("Unexpected element: %s %v", el, err)
+	}
+	restarted, err = tp.Start(opened)
+	if err != nil || len(restarted.Features) != 1 {
+		t.Error("Should restart the stream after authenticating")
+		t.Errorf("\nGot :%v %v", restarted.Features, err)
+	}
+	return opened, restarted
+}
+
+// Eventually calls cond until it returns true. If cond has not returned true
+// after a second the test is stopped. It is used to wait for the work of other
+// goroutines.
+func Eventually(t testing.TB, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met within a second")
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package xmpp holds the XML stream handling shared by the transports.
+package xmpp
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/nine/element"
+)
+
+// HandshakeTimeout is how long a client of a receiving transport has by
+// default to open its stream, and to negotiate TLS if the transport offers
+// it.
+const HandshakeTimeout = 10 * time.Second
+
+// DecodeElement reads the element that begins with start from dec. The
+// namespaces declared by the element are recorded in its Namespaces and
+// inherited by its children.
+func DecodeElement(start xml.StartElement, dec *xml.Decoder) (el element.Element, err error) {
+	ns := make(map[string]string)
+	return childElementsHelper(start, dec, ns)
+}
+
+func childElementsHelper(start xml.StartElement, dec *xml.Decoder, ns map[string]string) (el element.Element, err error) {
+	var children []element.Token
+
+	el = element.Element{
+		Space:      start.Name.Space,
+		Tag:        start.Name.Local,
+		Namespaces: ns,
+	}
+	for _, attr := range start.Attr {
+		el.Attr = append(
+			el.Attr,
+			element.Attr{
+				Space: attr.Name.Space,
+				Key:   attr.Name.Local,
+				Value: attr.Value,
+			},
+		)
+
+		if el.Space == "" && attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+			el.Namespaces[""] = attr.Value
+		}
+
+		if attr.Name.Space == "xmlns" && el.Space == attr.Name.Local {
+			el.Namespaces[attr.Name.Local] = attr.Value
+		}
+	}
+
+	nns := make(map[string]string)
+	for k, v := range el.Namespaces {
+		nns[k] = v
+	}
+	children, err = childElements(dec, nns)
+	el.Child = children
+	return
+}
+
+func childElements(dec *xml.Decoder, ns map[string]string) (children []element.Token, err error) {
+	var token xml.Token
+	var el element.Element
+	for {
+		token, err = dec.RawToken()
+		if err != nil {
+			return
+		}
+
+		switch elem := token.(type) {
+		case xml.StartElement:
+			el, err = childElementsHelper(elem, dec, ns)
+			if err != nil {
+				return
+			}
+			children = append(children, el)
+		case xml.EndElement:
+			return
+		case xml.CharData:
+			data := string(elem)
+			children = append(children, element.CharData{Data: data})
+		}
+	}
+}
+
+// StreamID generates a unique ID for a stream.
+func StreamID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return fmt.Sprintf("%x", id)
+}
+
+// Domains returns a function that reports if a domain is one of domains.
+func Domains(domains ...string) func(domain string) bool {
+	served := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		served[domain] = struct{}{}
+	}
+	return func(domain string) bool {
+		_, ok := served[domain]
+		return ok
+	}
+}
+
+// Domain returns the domain requested by to and whether it is served. If to is
+// empty the server's domain is requested. Served reports if a domain is
+// served, if it is nil only server is served.
+func Domain(to, server string, served func(domain string) bool) (string, bool) {
+	if to == "" {
+		to = server
+	}
+	if served == nil {
+		return to, to == server
+	}
+	return to, served(to)
+}
+
+// Features returns the stream features in el. If el is not a features element
+// transport.ErrFeaturesExpected is returned.
+func Features(el element.Element) ([]element.Element, error) {
+	if el.Tag != "features" {
+		log.Printf("Received element instead of features: %s", el)
+		return nil, transport.ErrFeaturesExpected
+	}
+	return el.ChildElements(), nil
+}
@@ -0,0 +1,110 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/nine/element"
+)
+
+func TestDecodeElement(t *testing.T) {
+	t.Parallel()
+
+	dec := xml.NewDecoder(strings.NewReader(
+		`<stream:features xmlns:stream='http://etherx.jabber.org/streams'>` +
+			`<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>text</bind></stream:features>`))
+	token, err := dec.RawToken()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	el, err := DecodeElement(token.(xml.StartElement), dec)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Should record the namespaces declared by the element
+	want := map[string]string{"stream": "http://etherx.jabber.org/streams"}
+	if el.Space != "stream" || el.Tag != "features" || !reflect.DeepEqual(want, el.Namespaces) {
+		t.Error("Should record the namespaces declared by the element")
+		t.Errorf("\nWant:%v\nGot :%v", want, el.Namespaces)
+	}
+
+	// Should inherit the namespaces of the parent
+	children := el.ChildElements()
+	if len(children) != 1 {
+		t.Fatalf("Should decode the children of the element\nGot :%v", el.Child)
+	}
+	want = map[string]string{"stream": "http://etherx.jabber.org/streams", "": "urn:ietf:params:xml:ns:xmpp-bind"}
+	if !reflect.DeepEqual(want, children[0].Namespaces) {
+		t.Error("Should inherit the namespaces of the parent")
+		t.Errorf("\nWant:%v\nGot :%v", want, children[0].Namespaces)
+	}
+	if !reflect.DeepEqual([]element.Token{element.CharData{Data: "text"}}, children[0].Child) {
+		t.Error("Should decode character data")
+		t.Errorf("\nGot :%v", children[0].Child)
+	}
+}
+
+func TestDomain(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		to     string
+		served func(domain string) bool
+		domain string
+		ok     bool
+		msg    string
+	}{
+		{
+			to: "", domain: "localhost", ok: true,
+			msg: "Should use the server if no domain is requested",
+		},
+		{
+			to: "example.com", domain: "example.com", ok: false,
+			msg: "Should only serve the server if no domains are set",
+		},
+		{
+			to: "example.net", served: Domains("example.com", "example.net"),
+			domain: "example.net", ok: true,
+			msg: "Should serve the given domains",
+		},
+		{
+			to: "example.org", served: Domains("example.com"),
+			domain: "example.org", ok: false,
+			msg: "Should not serve unknown domains",
+		},
+		{
+			to: "", served: Domains("example.com"),
+			domain: "localhost", ok: false,
+			msg: "Should not serve the server if it is not one of the given domains",
+		},
+	}
+	for _, test := range tests {
+		domain, ok := Domain(test.to, "localhost", test.served)
+		if domain != test.domain || ok != test.ok {
+			t.Error(test.msg)
+			t.Errorf("\nWant:%s %t\nGot :%s %t", test.domain, test.ok, domain, ok)
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	t.Parallel()
+
+	// Should return the children of a features element
+	el := element.Element{Space: "stream", Tag: "features"}.AddChild(element.New("mechanisms"))
+	features, err := Features(el)
+	if err != nil || len(features) != 1 || features[0].Tag != "mechanisms" {
+		t.Error("Should return the children of a features element")
+		t.Errorf("\nGot :%v %v", features, err)
+	}
+
+	// Should require a features element
+	if _, err := Features(element.New("message")); err != transport.ErrFeaturesExpected {
+		t.Error("Should require a features element")
+		t.Errorf("\nWant:%s\nGot :%v", transport.ErrFeaturesExpected, err)
+	}
+}
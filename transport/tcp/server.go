@@ -0,0 +1,157 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/gabble/transport/internal/xmpp"
+	"github.com/skriptble/nine/stream"
+)
+
+// ErrServerClosed is the error returned by Serve and ListenAndServe once the
+// server has been closed.
+var ErrServerClosed = errors.New("tcp: server closed")
+
+// Server accepts XMPP client connections and runs a stream for each of them
+// with a stream factory.
+type Server struct {
+	factory transport.StreamFactory
+	server  string
+	config  *tls.Config
+	// hosts reports if the given domain is served by this server. If it is
+	// nil only server is served.
+	hosts func(domain string) bool
+	// certs are the certificates of the served domains, selected with SNI.
+	// They are guarded by lock, since they may be set while serving.
+	certs map[string]*tls.Certificate
+	// timeout is how long a client has to open the stream and negotiate TLS.
+	timeout time.Duration
+
+	listeners map[net.Listener]struct{}
+	closed    bool
+	lock      sync.Mutex
+}
+
+// NewServer creates a Server that runs the stream of each connection with
+// factory. Clients that do not request a domain are served server. If config
+// is not nil, or certificates are set, clients must negotiate STARTTLS before
+// anything else.
+func NewServer(factory transport.StreamFactory, server string, config *tls.Config) *Server {
+	s := new(Server)
+	s.factory = factory
+	s.server = server
+	s.config = config
+	s.timeout = xmpp.HandshakeTimeout
+	s.listeners = make(map[net.Listener]struct{})
+	return s
+}
+
+// HandshakeTimeout sets how long a client has to send its stream header and
+// negotiate TLS, whether direct or with STARTTLS. Connections that have not
+// been sent the features of the stream in time are closed.
+func (s *Server) HandshakeTimeout(d time.Duration) *Server {
+	s.timeout = d
+	return s
+}
+
+// ServeDomains sets the domains served by the server. Clients that request a
+// stream for any other domain receive a host-unknown stream error.
+func (s *Server) ServeDomains(domains ...string) *Server {
+	s.hosts = xmpp.Domains(domains...)
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr and serves the connections
+// it accepts.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections from ln and runs a stream for each of them until
+// the server is closed. ln is closed when Serve returns.
+func (s *Server) Serve(ln net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.lock.Unlock()
+	config := s.tlsConfig()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, ln)
+		s.lock.Unlock()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("Accept error ", err)
+				continue
+			}
+			return err
+		}
+		go s.handle(conn, config)
+	}
+}
+
+// Close stops the server from accepting connections. Streams that are running
+// are not closed.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	return nil
+}
+
+// handle reads the stream header of conn and runs the stream for the domain
+// the client requested. STARTTLS is negotiated with config. The stream must
+// be opened before the handshake timeout.
+func (s *Server) handle(conn net.Conn, config *tls.Config) {
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	t := newTransport(stream.Receiving, conn, config)
+	t.timed = true
+	hdr, err := t.readHeader()
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	to := attr(hdr, "to", "")
+	domain, ok := s.domain(to)
+	if !ok {
+		log.Println("Stream opened for unknown host ", to)
+		t.writeHeader(stream.Header{From: s.server, ID: xmpp.StreamID(), Version: "1.0"})
+		t.streamError("host-unknown")
+		return
+	}
+	t.header = &hdr
+	s.factory(t, domain)
+}
+
+// domain returns the domain requested by to and whether it is served by the
+// server. If to is empty the server's own domain is requested.
+func (s *Server) domain(to string) (string, bool) {
+	return xmpp.Domain(to, s.server, s.hosts)
+}
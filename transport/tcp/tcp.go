@@ -0,0 +1,383 @@
+// Package tcp implements the XMPP client-to-server transport over TCP
+// described in RFC 6120, including STARTTLS negotiation and direct TLS as
+// described in XEP-0368.
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/skriptble/gabble/transport/internal/xmpp"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/element/stanza"
+	"github.com/skriptble/nine/namespace"
+	"github.com/skriptble/nine/stream"
+)
+
+// streams is the namespace of stream error conditions.
+const streams = "urn:ietf:params:xml:ns:xmpp-streams"
+
+// ErrHeaderExpected is the error returned when a stream is started and the
+// other side sends something other than a stream header.
+var ErrHeaderExpected = errors.New("tcp: expected a stream header")
+
+// ErrTLSRequired is the error returned from Start when the initiating side
+// does not negotiate TLS with a receiving transport that requires it.
+var ErrTLSRequired = errors.New("tcp: TLS required")
+
+// ErrTLSFailed is the error returned from Start when the receiving side
+// refuses to negotiate TLS.
+var ErrTLSFailed = errors.New("tcp: TLS negotiation failed")
+
+// ErrUnencryptedData is the error returned from Start when the other side
+// sends data after the STARTTLS request or response that would be read
+// before TLS has been negotiated.
+var ErrUnencryptedData = errors.New("tcp: unencrypted data after STARTTLS")
+
+// Transport implements a stream.Transport over a TCP connection. If the
+// Transport has a TLS configuration and the connection is not already
+// encrypted, STARTTLS is negotiated when the stream is started. A receiving
+// Transport requires the initiating side to negotiate it.
+type Transport struct {
+	mode   stream.Mode
+	conn   net.Conn
+	config *tls.Config
+	secure bool
+
+	r   *bufio.Reader
+	dec *xml.Decoder
+	// header is a stream header that has been read but not yet handled by
+	// Start.
+	header *xml.StartElement
+	// timed is true while the connection has a deadline for opening the
+	// stream, which is cleared once the features are sent.
+	timed bool
+	// ended is true once the end of the stream has been written. It is
+	// guarded by lock.
+	ended bool
+	// lock serializes writes to the connection.
+	lock sync.Mutex
+}
+
+// NewTransport creates a Transport for conn. If config is not nil STARTTLS is
+// negotiated using it, a receiving Transport needs a certificate in config.
+func NewTransport(mode stream.Mode, conn net.Conn, config *tls.Config) stream.Transport {
+	return newTransport(mode, conn, config)
+}
+
+func newTransport(mode stream.Mode, conn net.Conn, config *tls.Config) *Transport {
+	t := new(Transport)
+	t.mode = mode
+	t.config = config
+	t.use(conn)
+	_, t.secure = conn.(*tls.Conn)
+	return t
+}
+
+// Dial connects to the XMPP server at address and returns an initiating
+// Transport for it. If config is not nil STARTTLS is negotiated when the
+// stream is started.
+func Dial(address string, config *tls.Config) (stream.Transport, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransport(stream.Initiating, conn, config), nil
+}
+
+// Close implements io.Closer. The stream is closed before the connection.
+func (t *Transport) Close() error {
+	t.end()
+	return t.conn.Close()
+}
+
+// WriteElement writes el to the stream.
+func (t *Transport) WriteElement(el element.Element) error {
+	return t.write(el.WriteBytes())
+}
+
+// WriteStanza writes the given stanza to the stream.
+func (t *Transport) WriteStanza(st stanza.Stanza) error {
+	return t.WriteElement(st.TransformElement())
+}
+
+// Next returns the next element from the stream. A new stream header returns
+// stream.ErrRequireRestart and the end of the stream returns
+// stream.ErrStreamClosed.
+func (t *Transport) Next() (element.Element, error) {
+	for {
+		token, err := t.dec.RawToken()
+		if err != nil {
+			return element.Element{}, err
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			if header(tok) {
+				t.header = &tok
+				return element.Element{}, stream.ErrRequireRestart
+			}
+			return xmpp.DecodeElement(tok, t.dec)
+		case xml.EndElement:
+			if t.mode == stream.Receiving {
+				t.end()
+			}
+			return element.Element{}, stream.ErrStreamClosed
+		}
+		// Whitespace between elements is used to keep the connection alive.
+	}
+}
+
+// Start starts or restarts the stream. A receiving transport waits for the
+// stream header of the initiating side and sends its own followed by the
+// features. An initiating transport sends its stream header and returns the
+// features it receives. STARTTLS is negotiated by Start before the features
+// in p are sent or returned.
+func (t *Transport) Start(p stream.Properties) (stream.Properties, error) {
+	if p.Domain == "" {
+		return p, stream.ErrDomainNotSet
+	}
+	if t.mode == stream.Initiating {
+		return t.initiate(p)
+	}
+
+	hdr, err := t.readHeader()
+	if err != nil {
+		return p, err
+	}
+	p.Header = stream.Header{
+		Lang:    attr(hdr, "lang", "en"),
+		Version: "1.0",
+		ID:      xmpp.StreamID(),
+		To:      attr(hdr, "from", ""),
+		From:    p.Domain,
+	}
+	if err := t.writeHeader(p.Header); err != nil {
+		return p, err
+	}
+	if t.config == nil || t.secure {
+		if t.timed {
+			t.conn.SetDeadline(time.Time{})
+			t.timed = false
+		}
+		return p, t.writeFeatures(p.Features)
+	}
+
+	// The initiating side must negotiate TLS before anything else.
+	starttls := element.New("starttls").AddAttr("xmlns", namespace.TLS).AddChild(element.New("required"))
+	if err := t.writeFeatures([]element.Element{starttls}); err != nil {
+		return p, err
+	}
+	el, err := t.Next()
+	if err != nil {
+		return p, err
+	}
+	if el.Tag != "starttls" || el.SelectAttrValue("xmlns", "") != namespace.TLS {
+		log.Printf("Recieved element instead of starttls: %s", el)
+		t.streamError("policy-violation")
+		return p, ErrTLSRequired
+	}
+	if t.r.Buffered() > 0 {
+		t.streamError("policy-violation")
+		return p, ErrUnencryptedData
+	}
+	if err := t.WriteElement(element.New("proceed").AddAttr("xmlns", namespace.TLS)); err != nil {
+		return p, err
+	}
+	conn := tls.Server(t.conn, t.config)
+	if err := conn.Handshake(); err != nil {
+		return p, err
+	}
+	t.upgrade(conn)
+	return t.Start(p)
+}
+
+// initiate sends the stream header for the domain of p and reads the features
+// sent by the receiving side, negotiating STARTTLS if it is offered.
+func (t *Transport) initiate(p stream.Properties) (stream.Properties, error) {
+	hdr := stream.Header{To: p.Domain, Version: "1.0", Lang: p.Header.Lang}
+	if err := t.writeHeader(hdr); err != nil {
+		return p, err
+	}
+	start, err := t.readHeader()
+	if err != nil {
+		return p, err
+	}
+	p.Header.ID = attr(start, "id", "")
+	p.Header.From = attr(start, "from", "")
+	p.Header.Version = attr(start, "version", "")
+	el, err := t.Next()
+	if err != nil {
+		return p, err
+	}
+	if p.Features, err = xmpp.Features(el); err != nil {
+		return p, err
+	}
+	if t.config == nil || t.secure || !offered(p.Features) {
+		return p, nil
+	}
+
+	if err := t.WriteElement(element.New("starttls").AddAttr("xmlns", namespace.TLS)); err != nil {
+		return p, err
+	}
+	el, err = t.Next()
+	if err != nil {
+		return p, err
+	}
+	if el.Tag != "proceed" {
+		return p, ErrTLSFailed
+	}
+	if t.r.Buffered() > 0 {
+		return p, ErrUnencryptedData
+	}
+	config := t.config
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = p.Domain
+	}
+	conn := tls.Client(t.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return p, err
+	}
+	t.upgrade(conn)
+	return t.initiate(p)
+}
+
+// readHeader returns the next stream header, which may already have been read
+// by Next.
+func (t *Transport) readHeader() (xml.StartElement, error) {
+	if t.header != nil {
+		hdr := *t.header
+		t.header = nil
+		return hdr, nil
+	}
+	for {
+		token, err := t.dec.RawToken()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			if !header(tok) {
+				log.Printf("Recieved %s instead of a stream header", tok.Name.Local)
+				return tok, ErrHeaderExpected
+			}
+			return tok, nil
+		case xml.ProcInst, xml.CharData, xml.Comment:
+		default:
+			return xml.StartElement{}, ErrHeaderExpected
+		}
+	}
+}
+
+// writeHeader writes the XML declaration and a stream header with the given
+// attributes.
+func (t *Transport) writeHeader(h stream.Header) error {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version='1.0'?><stream:stream")
+	for _, a := range []struct{ key, value string }{
+		{"from", h.From},
+		{"to", h.To},
+		{"id", h.ID},
+		{"version", h.Version},
+		{"xml:lang", h.Lang},
+	} {
+		if a.value == "" {
+			continue
+		}
+		buf.WriteString(" " + a.key + "='")
+		xml.EscapeText(&buf, []byte(a.value))
+		buf.WriteString("'")
+	}
+	fmt.Fprintf(&buf, " xmlns='%s' xmlns:stream='%s'>", namespace.Client, namespace.Stream)
+	return t.write(buf.Bytes())
+}
+
+// writeFeatures writes the stream features.
+func (t *Transport) writeFeatures(features []element.Element) error {
+	ftrs := element.New("stream:features")
+	for _, f := range features {
+		ftrs = ftrs.AddChild(f)
+	}
+	return t.WriteElement(ftrs)
+}
+
+// streamError writes a stream error with the given condition and closes the
+// stream.
+func (t *Transport) streamError(condition string) {
+	cond := element.New(condition).AddAttr("xmlns", streams)
+	t.WriteElement(element.New("stream:error").AddChild(cond))
+	t.Close()
+}
+
+// upgrade replaces the connection with its encrypted version. The stream is
+// restarted after TLS has been negotiated.
+func (t *Transport) upgrade(conn *tls.Conn) {
+	t.use(conn)
+	t.secure = true
+}
+
+// use reads from and writes to conn. The decoder reads from a bufio.Reader,
+// which it uses without further buffering, but anything the previous reader
+// has buffered is discarded. STARTTLS fails before the connection is replaced
+// if the other side has sent anything that would be lost.
+func (t *Transport) use(conn net.Conn) {
+	t.lock.Lock()
+	t.conn = conn
+	t.lock.Unlock()
+	t.r = bufio.NewReader(conn)
+	t.dec = xml.NewDecoder(t.r)
+}
+
+// write writes b to the connection.
+func (t *Transport) write(b []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, err := t.conn.Write(b)
+	return err
+}
+
+// end writes the end of the stream unless it has already been written.
+func (t *Transport) end() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ended {
+		return nil
+	}
+	t.ended = true
+	_, err := t.conn.Write([]byte("</stream:stream>"))
+	return err
+}
+
+// header returns true if start is a stream header.
+func header(start xml.StartElement) bool {
+	return start.Name.Space == "stream" && start.Name.Local == "stream"
+}
+
+// offered returns true if STARTTLS is among the features.
+func offered(features []element.Element) bool {
+	for _, f := range features {
+		if f.Tag == "starttls" {
+			return true
+		}
+	}
+	return false
+}
+
+// attr returns the value of the attribute of start with the given local name,
+// or dflt if it does not have one.
+func attr(start xml.StartElement, key, dflt string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == key {
+			return a.Value
+		}
+	}
+	return dflt
+}
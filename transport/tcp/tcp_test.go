@@ -0,0 +1,266 @@
+package tcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
+	"github.com/skriptble/nine/stream"
+)
+
+// certificate returns a self-signed certificate for the given names and a
+// pool that trusts it.
+func certificate(t *testing.T, names ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// serve starts s on a local address and returns the address.
+func serve(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	cert, pool := certificate(t, "localhost")
+	s := NewServer(transporttest.EchoStream, "localhost", &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer s.Close()
+	tp, err := Dial(serve(t, s), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer tp.Close()
+
+	opened, restarted := transporttest.EchoClient(t, tp, "localhost")
+	if !tp.(*Transport).secure {
+		t.Error("Should negotiate STARTTLS")
+	}
+	if opened.Header.From != "localhost" || opened.Header.ID == "" {
+		t.Error("Should return the header of the stream")
+		t.Errorf("\nGot :%+v", opened.Header)
+	}
+	if restarted.Header.ID == opened.Header.ID {
+		t.Error("Should restart the stream with a new header")
+		t.Errorf("\nGot :%+v", restarted.Header)
+	}
+
+	// Should end the stream when the other side closes it
+	if err := tp.(*Transport).write([]byte("</stream:stream>")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := tp.Next(); err != stream.ErrStreamClosed {
+		t.Error("Should end the stream when the other side closes it")
+		t.Errorf("\nWant:%s\nGot :%v", stream.ErrStreamClosed, err)
+	}
+}
+
+func TestTransportPlain(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(transporttest.EchoStream, "localhost", nil)
+	defer s.Close()
+	addr := serve(t, s)
+
+	// Should not negotiate TLS if the server does not offer it
+	_, pool := certificate(t, "localhost")
+	tp, err := Dial(addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	p, err := tp.Start(stream.Properties{Domain: "localhost"})
+	if err != nil || len(p.Features) != 1 || tp.(*Transport).secure {
+		t.Error("Should not negotiate TLS if the server does not offer it")
+		t.Errorf("\nGot :%v %v", p.Features, err)
+	}
+	tp.Close()
+
+	// Should send a stream error for unknown hosts
+	tp, err = Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = tp.Start(stream.Properties{Domain: "example.com"})
+	if err != transport.ErrFeaturesExpected {
+		t.Error("Should send a stream error for unknown hosts")
+		t.Errorf("\nWant:%s\nGot :%v", transport.ErrFeaturesExpected, err)
+	}
+	tp.Close()
+}
+
+func TestTransportTLSRequired(t *testing.T) {
+	t.Parallel()
+
+	cert, _ := certificate(t, "localhost")
+	s := NewServer(transporttest.EchoStream, "localhost", &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer s.Close()
+
+	// Should only offer STARTTLS until TLS has been negotiated
+	tp, err := Dial(serve(t, s), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer tp.Close()
+	p, err := tp.Start(stream.Properties{Domain: "localhost"})
+	if err != nil || len(p.Features) != 1 || p.Features[0].Tag != "starttls" {
+		t.Error("Should only offer STARTTLS until TLS has been negotiated")
+		t.Errorf("\nGot :%v %v", p.Features, err)
+	}
+
+	// Should close the stream if the client does not negotiate TLS
+	if err := tp.WriteElement(element.New("auth").AddAttr("xmlns", namespace.SASL)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	el, err := tp.Next()
+	if err != nil || el.Tag != "error" {
+		t.Error("Should close the stream if the client does not negotiate TLS")
+		t.Errorf("\nGot :%s %v", el, err)
+	}
+}
+
+func TestTransportUnencryptedData(t *testing.T) {
+	t.Parallel()
+
+	cert, _ := certificate(t, "localhost")
+	client, server := net.Pipe()
+	defer client.Close()
+	tp := newTransport(stream.Receiving, server, &tls.Config{Certificates: []tls.Certificate{cert}})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tp.Start(stream.Properties{Domain: "localhost"})
+		errs <- err
+	}()
+	go io.Copy(io.Discard, client)
+
+	// Should not negotiate TLS if data follows the STARTTLS request
+	io.WriteString(client, "<stream:stream to='localhost' version='1.0' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams'>"+
+		"<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/><message/>")
+	select {
+	case err := <-errs:
+		if err != ErrUnencryptedData {
+			t.Error("Should not negotiate TLS if data follows the STARTTLS request")
+			t.Errorf("\nWant:%s\nGot :%v", ErrUnencryptedData, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Should not negotiate TLS if data follows the STARTTLS request")
+	}
+}
+
+func TestTransportEnd(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	tp := newTransport(stream.Receiving, server, nil)
+	out := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		out <- b
+	}()
+	go io.WriteString(client, "<stream:stream to='localhost' version='1.0' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams'></stream:stream>")
+	if _, err := tp.Start(stream.Properties{Domain: "localhost"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := tp.Next(); err != stream.ErrStreamClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tp.Close()
+
+	// Should end the stream once when it is closed after the other side ended it
+	b := <-out
+	if n := strings.Count(string(b), "</stream:stream>"); n != 1 {
+		t.Error("Should end the stream once when it is closed after the other side ended it")
+		t.Errorf("\nWant:%d\nGot :%d", 1, n)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(transporttest.EchoStream, "localhost", nil).HandshakeTimeout(10 * time.Millisecond)
+	defer s.Close()
+
+	// Should close connections that do not open the stream in time
+	conn, err := net.Dial("tcp", serve(t, s))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Should close connections that do not open the stream in time")
+		t.Errorf("\nWant:%s\nGot :%v", io.EOF, err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(transporttest.EchoStream, "localhost", nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(ln) }()
+
+	// Should stop serving once closed
+	transporttest.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.listeners) != 0
+	})
+	s.Close()
+	select {
+	case err := <-errs:
+		if err != ErrServerClosed {
+			t.Error("Should stop serving once closed")
+			t.Errorf("\nWant:%s\nGot :%v", ErrServerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Should stop serving once closed")
+	}
+}
@@ -0,0 +1,118 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/skriptble/nine/stream"
+)
+
+// ALPNClient is the ALPN protocol of client-to-server XMPP over direct TLS
+// described in XEP-0368.
+const ALPNClient = "xmpp-client"
+
+// ErrNoCertificate is the error returned when direct TLS is served by a Server
+// that has neither a TLS configuration nor certificates.
+var ErrNoCertificate = errors.New("tcp: no certificate for direct TLS")
+
+// DialTLS connects to the XMPP server at address using direct TLS and returns
+// an initiating Transport for it. The xmpp-client ALPN protocol is requested
+// unless config sets its own, and the host of address is used as the server
+// name unless config sets one. STARTTLS is not negotiated on the connection.
+func DialTLS(address string, config *tls.Config) (stream.Transport, error) {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{ALPNClient}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransport(stream.Initiating, conn, config), nil
+}
+
+// Certificate sets the certificate presented to clients that request domain
+// with SNI. Clients that request a domain without a certificate are presented
+// the certificate of the server's domain, if there is one, or those of the
+// server's TLS configuration. Certificate may be called while the server is
+// serving, but only listeners served once the server has a certificate or a
+// TLS configuration negotiate TLS.
+func (s *Server) Certificate(domain string, cert tls.Certificate) *Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.certs == nil {
+		s.certs = make(map[string]*tls.Certificate)
+	}
+	s.certs[domain] = &cert
+	return s
+}
+
+// ListenAndServeTLS listens on the TCP address addr and serves the connections
+// it accepts over direct TLS.
+func (s *Server) ListenAndServeTLS(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln)
+}
+
+// ServeTLS accepts connections from ln and serves them over direct TLS, as
+// described in XEP-0368, until the server is closed. The xmpp-client ALPN
+// protocol is offered unless the server's TLS configuration sets its own,
+// server-to-server streams are not served. ln is closed when ServeTLS
+// returns.
+func (s *Server) ServeTLS(ln net.Listener) error {
+	config := s.tlsConfig()
+	if config == nil {
+		ln.Close()
+		return ErrNoCertificate
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{ALPNClient}
+	}
+	return s.Serve(tls.NewListener(ln, config))
+}
+
+// tlsConfig returns the TLS configuration used for STARTTLS and direct TLS,
+// which selects the certificate for the domain requested with SNI. If the
+// server has neither a TLS configuration nor certificates nil is returned.
+func (s *Server) tlsConfig() *tls.Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.certs == nil {
+		if s.config == nil {
+			return nil
+		}
+		return s.config.Clone()
+	}
+	config := new(tls.Config)
+	if s.config != nil {
+		config = s.config.Clone()
+	}
+	config.GetCertificate = s.certificate
+	return config
+}
+
+// certificate returns the certificate for the domain the client requested. If
+// nil is returned the certificates of the TLS configuration are used.
+func (s *Server) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cert, ok := s.certs[hello.ServerName]; ok {
+		return cert, nil
+	}
+	return s.certs[s.server], nil
+}
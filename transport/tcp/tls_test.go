@@ -0,0 +1,85 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/stream"
+)
+
+func TestServerServeTLS(t *testing.T) {
+	t.Parallel()
+
+	local, _ := certificate(t, "localhost")
+	other, otherPool := certificate(t, "example.com")
+	s := NewServer(transporttest.EchoStream, "localhost", nil).
+		ServeDomains("localhost", "example.com").
+		Certificate("localhost", local).
+		Certificate("example.com", other)
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go s.ServeTLS(ln)
+
+	// Should negotiate the xmpp-client protocol and select the certificate of
+	// the requested domain
+	tp, err := DialTLS(ln.Addr().String(), &tls.Config{RootCAs: otherPool, ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer tp.Close()
+	state := tp.(*Transport).conn.(*tls.Conn).ConnectionState()
+	if state.NegotiatedProtocol != ALPNClient {
+		t.Error("Should negotiate the xmpp-client protocol")
+		t.Errorf("\nWant:%s\nGot :%s", ALPNClient, state.NegotiatedProtocol)
+	}
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "example.com" {
+		t.Error("Should select the certificate of the requested domain")
+		t.Errorf("\nWant:%s\nGot :%s", "example.com", cn)
+	}
+
+	// Should start the stream without STARTTLS
+	p, err := tp.Start(stream.Properties{Domain: "example.com"})
+	if err != nil || len(p.Features) != 1 || p.Features[0].Tag != "mechanisms" {
+		t.Error("Should start the stream without STARTTLS")
+		t.Errorf("\nGot :%v %v", p.Features, err)
+	}
+
+	// Should not serve server-to-server streams
+	go s.Certificate("example.net", other)
+	if tp, err := DialTLS(ln.Addr().String(), &tls.Config{RootCAs: otherPool, ServerName: "example.com",
+		NextProtos: []string{"xmpp-server"}}); err == nil {
+		t.Error("Should not serve server-to-server streams")
+		tp.Close()
+	}
+
+	// Should present the certificate of the server's domain by default
+	hello := &tls.ClientHelloInfo{ServerName: "unknown.example.com"}
+	s.lock.Lock()
+	want := s.certs["localhost"]
+	s.lock.Unlock()
+	if cert, err := s.certificate(hello); err != nil || cert != want {
+		t.Error("Should present the certificate of the server's domain by default")
+		t.Errorf("\nGot :%v %v", cert, err)
+	}
+}
+
+func TestServerServeTLSNoCertificate(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(transporttest.EchoStream, "localhost", nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Should require a certificate to serve direct TLS
+	if err := s.ServeTLS(ln); err != ErrNoCertificate {
+		t.Error("Should require a certificate to serve direct TLS")
+		t.Errorf("\nWant:%s\nGot :%v", ErrNoCertificate, err)
+	}
+}
@@ -0,0 +1,20 @@
+// Package transport holds what the XMPP transports in its subpackages have in
+// common, so a server can run the same streams over each of them.
+package transport
+
+import (
+	"errors"
+
+	"github.com/skriptble/nine/stream"
+)
+
+// ErrFeaturesExpected is the error returned from Start by the initiating side
+// of a transport when the receiving side sends something other than stream
+// features after opening the stream.
+var ErrFeaturesExpected = errors.New("expected stream features")
+
+// A StreamFactory runs an XMPP stream over the given transport for a client
+// that requested the given domain. It is called for the stream of every
+// connection or session a transport accepts, and must not block. Giving the
+// same StreamFactory to each transport lets one server offer all of them.
+type StreamFactory func(tp stream.Transport, domain string)
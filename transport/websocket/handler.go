@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/gabble/transport/internal/xmpp"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/stream"
+)
+
+// defaultMaxMessageSize is the largest message in bytes read from a
+// connection unless the handler sets another.
+const defaultMaxMessageSize = 1 << 20
+
+// Handler accepts XMPP over WebSocket connections. The stream of each
+// connection is run by a stream factory.
+type Handler struct {
+	factory transport.StreamFactory
+	server  string
+	// hosts reports if the given domain is served by this handler. If it is
+	// nil only server is served.
+	hosts func(domain string) bool
+	// origins are the origins browsers may connect from. If it is empty only
+	// connections from the same host are accepted.
+	origins []string
+	// seeOther is where new connections are sent instead of being served.
+	seeOther string
+	// maxMessage is the largest message in bytes read from a connection.
+	maxMessage int64
+	// timeout is how long a client has to open the stream once the
+	// connection has been upgraded.
+	timeout time.Duration
+}
+
+// NewHandler creates a Handler that runs the stream of each connection with
+// factory. Clients that do not request a domain are served server.
+func NewHandler(factory transport.StreamFactory, server string) *Handler {
+	h := new(Handler)
+	h.factory = factory
+	h.server = server
+	h.maxMessage = defaultMaxMessageSize
+	h.timeout = xmpp.HandshakeTimeout
+	return h
+}
+
+// ServeDomains sets the domains served by the handler. Clients that request a
+// stream for any other domain receive a host-unknown stream error.
+func (h *Handler) ServeDomains(domains ...string) *Handler {
+	h.hosts = xmpp.Domains(domains...)
+	return h
+}
+
+// AllowOrigins sets the origins browsers may connect from. An origin of "*"
+// allows every origin. By default only connections from the same host are
+// accepted.
+func (h *Handler) AllowOrigins(origins ...string) *Handler {
+	h.origins = origins
+	return h
+}
+
+// SeeOtherURI sets the URI new connections are sent to. Clients are told to
+// reconnect to it with a see-other-uri instead of being served, which allows
+// the handler to move clients to another server.
+func (h *Handler) SeeOtherURI(uri string) *Handler {
+	h.seeOther = uri
+	return h
+}
+
+// MaxMessageSize sets the largest message in bytes read from a connection.
+// Connections that send larger messages are closed.
+func (h *Handler) MaxMessageSize(n int64) *Handler {
+	h.maxMessage = n
+	return h
+}
+
+// HandshakeTimeout sets how long a client has to send the <open/> element
+// once the connection has been upgraded. Connections that do not open the
+// stream in time are closed.
+func (h *Handler) HandshakeTimeout(d time.Duration) *Handler {
+	h.timeout = d
+	return h
+}
+
+// ServeHTTP implements http.Handler. The connection is upgraded to a WebSocket
+// with the xmpp subprotocol, the stream is opened, and the stream is run by
+// the handler's stream factory.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !offered(websocket.Subprotocols(r)) {
+		http.Error(rw, "xmpp subprotocol required", http.StatusBadRequest)
+		return
+	}
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{Subprotocol},
+		CheckOrigin:  h.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	conn.SetReadLimit(h.maxMessage)
+	t := newTransport(stream.Receiving, conn)
+	conn.SetReadDeadline(time.Now().Add(h.timeout))
+	open, err := t.readOpen()
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if h.seeOther != "" {
+		t.Redirect(h.seeOther)
+		return
+	}
+	domain, ok := h.domain(open.SelectAttrValue("to", ""))
+	if !ok {
+		log.Println("Stream opened for unknown host ", open.SelectAttrValue("to", ""))
+		h.refuse(t, open)
+		return
+	}
+	t.open = &open
+	h.factory(t, domain)
+}
+
+// refuse answers the <open/> element with a host-unknown stream error and
+// closes the stream.
+func (h *Handler) refuse(t *Transport, open element.Element) {
+	if _, err := t.accept(open, h.server); err != nil {
+		t.conn.Close()
+		return
+	}
+	cond := element.New("host-unknown").AddAttr("xmlns", "urn:ietf:params:xml:ns:xmpp-streams")
+	t.WriteElement(element.New("stream:error").AddChild(cond))
+	t.Close()
+}
+
+// domain returns the domain requested by to and whether it is served by the
+// handler. If to is empty the handler's server is requested.
+func (h *Handler) domain(to string) (string, bool) {
+	return xmpp.Domain(to, h.server, h.hosts)
+}
+
+// checkOrigin returns true if the browser making r may connect.
+func (h *Handler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range h.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	if len(h.origins) == 0 {
+		return origin == "http://"+r.Host || origin == "https://"+r.Host
+	}
+	return false
+}
+
+// offered returns true if the xmpp subprotocol is among protocols.
+func offered(protocols []string) bool {
+	for _, p := range protocols {
+		if p == Subprotocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+// Package websocket implements XMPP over WebSocket as described in RFC 7395.
+// Each WebSocket message holds one complete XML element, the stream is opened
+// with an <open/> element instead of a stream header and closed with a
+// <close/> element.
+package websocket
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/skriptble/gabble/transport/internal/xmpp"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/element/stanza"
+	"github.com/skriptble/nine/namespace"
+	"github.com/skriptble/nine/stream"
+)
+
+// Subprotocol is the WebSocket subprotocol for XMPP.
+const Subprotocol = "xmpp"
+
+// framing is the namespace of the <open/> and <close/> elements.
+const framing = "urn:ietf:params:xml:ns:xmpp-framing"
+
+// ErrSubprotocol is the error returned when the other side of a WebSocket
+// connection did not agree to the xmpp subprotocol.
+var ErrSubprotocol = errors.New("websocket: xmpp subprotocol not negotiated")
+
+// ErrOpenExpected is the error returned when a stream is started and the
+// other side sends an element other than <open/>.
+var ErrOpenExpected = errors.New("websocket: expected an open element")
+
+// ErrInvalidUTF8 is the error returned when the other side sends a message
+// that is not valid UTF-8. The connection is closed with the
+// invalid-frame-payload-data status.
+var ErrInvalidUTF8 = errors.New("websocket: message is not valid UTF-8")
+
+// A SeeOtherURIError is the error returned when the other side closes the
+// stream with a see-other-uri. The client should reconnect to URI.
+type SeeOtherURIError struct {
+	URI string
+}
+
+func (e *SeeOtherURIError) Error() string {
+	return "websocket: see other uri " + e.URI
+}
+
+// Transport implements a stream.Transport for XMPP over WebSocket.
+type Transport struct {
+	mode stream.Mode
+	conn *websocket.Conn
+
+	// open is an <open/> element that has been read but not yet handled by
+	// Start.
+	open *element.Element
+	// lock serializes writes, a websocket.Conn supports only one writer.
+	lock sync.Mutex
+}
+
+// NewTransport creates a Transport for the given WebSocket connection, which
+// must have negotiated the xmpp subprotocol.
+func NewTransport(mode stream.Mode, conn *websocket.Conn) stream.Transport {
+	return newTransport(mode, conn)
+}
+
+func newTransport(mode stream.Mode, conn *websocket.Conn) *Transport {
+	t := new(Transport)
+	t.mode = mode
+	t.conn = conn
+	return t
+}
+
+// Dial connects to the XMPP over WebSocket endpoint at url and returns an
+// initiating Transport for it. The stream is opened when it is started.
+func Dial(url string, header http.Header) (stream.Transport, error) {
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Subprotocol() != Subprotocol {
+		conn.Close()
+		return nil, ErrSubprotocol
+	}
+	return NewTransport(stream.Initiating, conn), nil
+}
+
+// Close implements io.Closer. The stream is closed with a <close/> element
+// before the connection is closed.
+func (t *Transport) Close() error {
+	t.write(element.New("close").AddAttr("xmlns", framing))
+	return t.conn.Close()
+}
+
+// Redirect closes the stream with a see-other-uri, telling the other side to
+// reconnect to uri, and closes the connection.
+func (t *Transport) Redirect(uri string) error {
+	t.write(element.New("close").AddAttr("xmlns", framing).AddAttr("see-other-uri", uri))
+	return t.conn.Close()
+}
+
+// WriteElement writes el to the connection as a single message. Elements
+// without a namespace are sent in the jabber:client namespace.
+func (t *Transport) WriteElement(el element.Element) error {
+	return t.write(qualify(el))
+}
+
+// WriteStanza writes the given stanza to the connection.
+func (t *Transport) WriteStanza(st stanza.Stanza) error {
+	return t.WriteElement(st.TransformElement())
+}
+
+// Next returns the next element from the connection. An <open/> element
+// returns stream.ErrRequireRestart, since it restarts the stream, and a
+// <close/> element returns stream.ErrStreamClosed.
+func (t *Transport) Next() (el element.Element, err error) {
+	el, err = t.read()
+	if err != nil {
+		return
+	}
+	switch {
+	case framed(el, "open"):
+		t.open = &el
+		err = stream.ErrRequireRestart
+	case framed(el, "close"):
+		err = t.closed(el)
+	}
+	return
+}
+
+// Start starts or restarts the stream. A receiving transport waits for the
+// <open/> element and sends its own followed by the features. An initiating
+// transport sends <open/> and returns the features it receives.
+func (t *Transport) Start(p stream.Properties) (stream.Properties, error) {
+	if p.Domain == "" {
+		return p, stream.ErrDomainNotSet
+	}
+	if t.mode == stream.Initiating {
+		return t.initiate(p)
+	}
+
+	open, err := t.readOpen()
+	if err != nil {
+		return p, err
+	}
+	if p.Header, err = t.accept(open, p.Domain); err != nil {
+		return p, err
+	}
+	ftrs := element.New("stream:features")
+	for _, f := range p.Features {
+		ftrs = ftrs.AddChild(f)
+	}
+	return p, t.WriteElement(ftrs)
+}
+
+// accept answers the <open/> element sent by the initiating side with the
+// <open/> element for a stream from domain, and returns the stream's header.
+func (t *Transport) accept(open element.Element, domain string) (stream.Header, error) {
+	h := stream.Header{
+		Lang:    open.SelectAttrValue("xml:lang", "en"),
+		Version: "1.0",
+		ID:      xmpp.StreamID(),
+		To:      open.SelectAttrValue("from", ""),
+		From:    domain,
+	}
+	reply := element.New("open").
+		AddAttr("xmlns", framing).
+		AddAttr("from", h.From).
+		AddAttr("id", h.ID).
+		AddAttr("version", h.Version).
+		AddAttr("xml:lang", h.Lang)
+	if h.To != "" {
+		reply = reply.AddAttr("to", h.To)
+	}
+	return h, t.write(reply)
+}
+
+// initiate opens the stream for the domain of p and reads the features sent
+// by the receiving side.
+func (t *Transport) initiate(p stream.Properties) (stream.Properties, error) {
+	open := element.New("open").
+		AddAttr("xmlns", framing).
+		AddAttr("to", p.Domain).
+		AddAttr("version", "1.0")
+	if p.Header.Lang != "" {
+		open = open.AddAttr("xml:lang", p.Header.Lang)
+	}
+	if err := t.write(open); err != nil {
+		return p, err
+	}
+	el, err := t.readOpen()
+	if err != nil {
+		return p, err
+	}
+	p.Header.ID = el.SelectAttrValue("id", "")
+	p.Header.From = el.SelectAttrValue("from", "")
+	p.Header.Version = el.SelectAttrValue("version", "")
+	el, err = t.read()
+	if err != nil {
+		return p, err
+	}
+	if framed(el, "close") {
+		return p, t.closed(el)
+	}
+	p.Features, err = xmpp.Features(el)
+	return p, err
+}
+
+// readOpen returns the next <open/> element, which may already have been read
+// by Next.
+func (t *Transport) readOpen() (element.Element, error) {
+	if t.open != nil {
+		el := *t.open
+		t.open = nil
+		return el, nil
+	}
+	el, err := t.read()
+	if err != nil {
+		return el, err
+	}
+	switch {
+	case framed(el, "open"):
+		return el, nil
+	case framed(el, "close"):
+		return el, t.closed(el)
+	}
+	log.Printf("Recieved element instead of open: %s", el)
+	return el, ErrOpenExpected
+}
+
+// closed handles a <close/> element received from the other side and returns
+// the error for it. A receiving transport answers with its own <close/>.
+func (t *Transport) closed(el element.Element) error {
+	if uri := el.SelectAttrValue("see-other-uri", ""); uri != "" {
+		return &SeeOtherURIError{URI: uri}
+	}
+	if t.mode == stream.Receiving {
+		t.write(element.New("close").AddAttr("xmlns", framing))
+	}
+	return stream.ErrStreamClosed
+}
+
+// read reads the next message from the connection and returns the element it
+// holds. RFC 7395 requires messages to be UTF-8, the connection is closed if
+// they are not.
+func (t *Transport) read() (element.Element, error) {
+	_, data, err := t.conn.ReadMessage()
+	if err != nil {
+		return element.Element{}, err
+	}
+	if !utf8.Valid(data) {
+		msg := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "")
+		t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		t.conn.Close()
+		return element.Element{}, ErrInvalidUTF8
+	}
+	return decode(data)
+}
+
+// write writes el to the connection as a single text message.
+func (t *Transport) write(el element.Element) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conn.WriteMessage(websocket.TextMessage, el.WriteBytes())
+}
+
+// framed returns true if el is the framing element with the given tag.
+func framed(el element.Element, tag string) bool {
+	return el.Tag == tag && el.SelectAttrValue("xmlns", "") == framing
+}
+
+// qualify returns el with the namespace declarations it needs to be sent in
+// a message of its own.
+func qualify(el element.Element) element.Element {
+	switch el.Space {
+	case "":
+		if el.SelectAttrValue("xmlns", "") == "" {
+			el = el.AddAttr("xmlns", namespace.Client)
+		}
+	case "stream":
+		if el.SelectAttrValue("xmlns:stream", "") == "" {
+			el = el.AddAttr("xmlns:stream", namespace.Stream)
+		}
+	}
+	return el
+}
+
+// decode returns the element encoded in data.
+func decode(data []byte) (element.Element, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := dec.RawToken()
+		if err != nil {
+			return element.Element{}, err
+		}
+		switch start := token.(type) {
+		case xml.StartElement:
+			return xmpp.DecodeElement(start, dec)
+		case xml.ProcInst, xml.CharData, xml.Comment:
+		default:
+			return element.Element{}, fmt.Errorf("websocket: unexpected token %T", token)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skriptble/gabble/transport"
+	"github.com/skriptble/gabble/transport/internal/transporttest"
+	"github.com/skriptble/nine/element"
+	"github.com/skriptble/nine/namespace"
+	"github.com/skriptble/nine/stream"
+)
+
+// wsURL returns the WebSocket URL of srv.
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dial opens a WebSocket connection with the xmpp subprotocol to srv without
+// starting a stream.
+func dial(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	conn, _, err := dialer.Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(NewHandler(transporttest.EchoStream, "localhost"))
+	defer srv.Close()
+	tp, err := Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	opened, restarted := transporttest.EchoClient(t, tp, "localhost")
+	if opened.Header.From != "localhost" || opened.Header.ID == "" {
+		t.Error("Should return the header of the opened stream")
+		t.Errorf("\nGot :%+v", opened.Header)
+	}
+	if restarted.Header.ID == opened.Header.ID {
+		t.Error("Should restart the stream with a new open element")
+		t.Errorf("\nGot :%+v", restarted.Header)
+	}
+
+	// Should send elements in the jabber:client namespace
+	if err := tp.WriteElement(element.New("message")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	el, err := tp.Next()
+	if err != nil || el.Tag != "message" || el.SelectAttrValue("xmlns", "") != namespace.Client {
+		t.Error("Should send elements in the jabber:client namespace")
+		t.Errorf("\nGot :%s %v", el, err)
+	}
+
+	// Should answer a close with a close
+	if err := tp.(*Transport).write(element.New("close").AddAttr("xmlns", framing)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := tp.Next(); err != stream.ErrStreamClosed {
+		t.Error("Should answer a close with a close")
+		t.Errorf("\nWant:%s\nGot :%v", stream.ErrStreamClosed, err)
+	}
+	tp.Close()
+}
+
+func TestHandlerServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(NewHandler(transporttest.EchoStream, "localhost"))
+	defer srv.Close()
+
+	// Should require the xmpp subprotocol
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Error("Should require the xmpp subprotocol")
+		t.Errorf("\nWant:%d\nGot :%d", http.StatusBadRequest, rsp.StatusCode)
+	}
+
+	// Should send a stream error for unknown hosts
+	tp, err := Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = tp.Start(stream.Properties{Domain: "example.com"})
+	if err != transport.ErrFeaturesExpected {
+		t.Error("Should not open streams for unknown hosts")
+		t.Errorf("\nWant:%s\nGot :%v", transport.ErrFeaturesExpected, err)
+	}
+	tp.Close()
+}
+
+func TestHandlerSeeOtherURI(t *testing.T) {
+	t.Parallel()
+
+	uri := "wss://other.example.com/xmpp"
+	srv := httptest.NewServer(NewHandler(transporttest.EchoStream, "localhost").SeeOtherURI(uri))
+	defer srv.Close()
+
+	// Should send clients to the other URI
+	tp, err := Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer tp.Close()
+	_, err = tp.Start(stream.Properties{Domain: "localhost"})
+	if se, ok := err.(*SeeOtherURIError); !ok || se.URI != uri {
+		t.Error("Should send clients to the other URI")
+		t.Errorf("\nWant:%s\nGot :%v", uri, err)
+	}
+}
+
+func TestHandlerHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(NewHandler(transporttest.EchoStream, "localhost").
+		HandshakeTimeout(10 * time.Millisecond))
+	defer srv.Close()
+
+	// Should close connections that do not open the stream in time
+	conn := dial(t, srv)
+	defer conn.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+		t.Error("Should close connections that do not open the stream in time")
+		t.Errorf("\nWant:%d\nGot :%v", websocket.CloseAbnormalClosure, err)
+	}
+}
+
+func TestHandlerMaxMessageSize(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(NewHandler(transporttest.EchoStream, "localhost").MaxMessageSize(16))
+	defer srv.Close()
+
+	// Should close connections that send messages larger than the limit
+	conn := dial(t, srv)
+	defer conn.Close()
+	open := element.New("open").AddAttr("xmlns", framing).AddAttr("to", "localhost")
+	if err := conn.WriteMessage(websocket.TextMessage, open.WriteBytes()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Should close connections that send messages larger than the limit")
+		t.Errorf("\nWant:%d\nGot :%v", websocket.CloseMessageTooBig, err)
+	}
+}
+
+func TestTransportInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(NewHandler(transporttest.EchoStream, "localhost"))
+	defer srv.Close()
+
+	// Should close connections that send messages that are not UTF-8
+	conn := dial(t, srv)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("<open to='\xff'/>")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData) {
+		t.Error("Should close connections that send messages that are not UTF-8")
+		t.Errorf("\nWant:%d\nGot :%v", websocket.CloseInvalidFramePayloadData, err)
+	}
+}
+
+func TestQualify(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		el   element.Element
+		attr string
+		want string
+	}{
+		{element.New("iq"), "xmlns", namespace.Client},
+		{element.New("success").AddAttr("xmlns", namespace.SASL), "xmlns", namespace.SASL},
+		{element.New("stream:features"), "xmlns:stream", namespace.Stream},
+	}
+	for _, test := range tests {
+		got := qualify(test.el).SelectAttrValue(test.attr, "")
+		if got != test.want {
+			t.Errorf("Should declare the namespace of %s", test.el.Tag)
+			t.Errorf("\nWant:%s\nGot :%s", test.want, got)
+		}
+	}
+}